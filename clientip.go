@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the address the request came from. Behind a reverse
+// proxy, set TRUST_PROXY=true so RemoteAddr is taken from the proxy's
+// X-Forwarded-For / X-Real-IP headers first.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// maxUserAgentLength caps how much of a User-Agent header is kept.
+const maxUserAgentLength = 256
+
+// clientUserAgent returns the request's User-Agent, shortened to
+// maxUserAgentLength bytes.
+func clientUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	return userAgent
+}
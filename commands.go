@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+// runCommand runs a maintenance command given on the command line.
+func runCommand(args []string, dbDriver, dbPath, jwtKeysDir string) error {
+	switch args[0] {
+	case "migrate":
+		return commandMigrate(args[1:], dbDriver, dbPath)
+	case "backup":
+		return commandBackup(args[1:], dbDriver, dbPath)
+	case "restore":
+		return commandRestore(args[1:], dbDriver, dbPath)
+	case "grant-role":
+		return commandGrantRole(args[1:], dbDriver, dbPath)
+	case "keys":
+		return commandKeys(args[1:], jwtKeysDir)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// commandMigrate inspects and applies database.json schema migrations.
+// The server must be stopped while migrating up or down.
+func commandMigrate(args []string, dbDriver, dbPath string) error {
+	if dbDriver != "" && dbDriver != database.DriverJSON {
+		return errors.New("migrate only applies to the json driver; SQLite schemas are migrated on startup")
+	}
+	if len(args) != 1 {
+		return errors.New("usage: chirpy migrate status|up|down")
+	}
+
+	version, infos, err := database.SchemaStatus(dbPath)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "status":
+		fmt.Printf("%s: schema version %d (latest %d)\n", dbPath, version, database.LatestSchemaVersion())
+		for _, info := range infos {
+			state := "pending"
+			if info.Applied {
+				state = "applied"
+			}
+			fmt.Printf("  %3d  %-8s %s\n", info.Version, state, info.Name)
+		}
+		return nil
+	case "up":
+		return database.MigrateTo(dbPath, database.LatestSchemaVersion())
+	case "down":
+		if version == 0 {
+			return errors.New("no migrations to revert")
+		}
+		return database.MigrateTo(dbPath, version-1)
+	default:
+		return errors.New("usage: chirpy migrate status|up|down")
+	}
+}
+
+// commandBackup writes a copy of the database to a file.
+// It only reads the database, so the server can keep running.
+func commandBackup(args []string, dbDriver, dbPath string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpy backup <file>")
+	}
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = database.BackupFile(dbDriver, dbPath, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(args[0])
+		return err
+	}
+
+	fmt.Printf("backed up %s to %s\n", dbPath, args[0])
+	return nil
+}
+
+// commandRestore replaces the database with a backup. It doesn't open
+// the current database, so it works even when that can't be opened.
+// The server must be stopped first.
+func commandRestore(args []string, dbDriver, dbPath string) error {
+	if len(args) != 1 {
+		return errors.New("usage: chirpy restore <file>")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = database.RestoreFile(dbDriver, dbPath, f)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %s from %s\n", dbPath, args[0])
+	return nil
+}
+
+// commandGrantRole gives the user with an email address a role, e.g.
+// `chirpy grant-role admin@example.com admin` to bootstrap the first
+// admin. The user gets the new role in tokens issued from now on.
+// Moderators and admins must have two-factor authentication enabled.
+// With the json driver the server must be stopped first; the command
+// refuses to run while it has the database open.
+func commandGrantRole(args []string, dbDriver, dbPath string) error {
+	if len(args) != 2 {
+		return errors.New("usage: chirpy grant-role <email> user|moderator|admin")
+	}
+	email, role := args[0], args[1]
+	if !database.ValidRole(role) {
+		return fmt.Errorf("unknown role %q", role)
+	}
+
+	db, err := database.Open(dbDriver, dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	user, err := db.GetUserByEmail(email)
+	if errors.Is(err, database.ErrNotExist) {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	if err != nil {
+		return err
+	}
+
+	if role != database.RoleUser {
+		totp, err := db.GetTOTP(user.ID)
+		if err != nil && !errors.Is(err, database.ErrNotExist) {
+			return err
+		}
+		if !totp.Enabled() {
+			return fmt.Errorf("%s must enable two-factor authentication before getting the %s role", email, role)
+		}
+	}
+
+	_, err = db.SetUserRole(user.ID, role)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("granted %s the %s role\n", email, role)
+	return nil
+}
+
+// commandKeys manages the JWT signing keys in JWT_KEYS_DIR.
+// `keys generate <kid> [ed25519|rsa]` writes a new private key; restart
+// the server with JWT_ACTIVE_KEY=<kid> to start signing with it.
+func commandKeys(args []string, jwtKeysDir string) error {
+	if len(args) < 2 || len(args) > 3 || args[0] != "generate" {
+		return errors.New("usage: chirpy keys generate <kid> [ed25519|rsa]")
+	}
+	if jwtKeysDir == "" {
+		return errors.New("JWT_KEYS_DIR environment variable is not set")
+	}
+
+	kid := args[1]
+	if kid == auth.LegacyKeyID || kid != filepath.Base(kid) {
+		return fmt.Errorf("invalid key ID %q", kid)
+	}
+	keyType := "ed25519"
+	if len(args) == 3 {
+		keyType = args[2]
+	}
+
+	dat, err := auth.GeneratePrivateKeyPEM(keyType)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(jwtKeysDir, 0700)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(jwtKeysDir, kid+".pem")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(dat)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	fmt.Printf("wrote %s key %s to %s\n", keyType, kid, path)
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+var errInvalidEmail = errors.New("Invalid email address")
+
+// normalizeEmail checks that s is a single bare address as defined by
+// RFC 5322, such as "someone@example.com", and returns it trimmed and
+// lower-cased so each mailbox maps to one account.
+func normalizeEmail(s string) (string, error) {
+	email := canonicalEmail(s)
+	if email == "" || len(email) > 254 {
+		return "", errInvalidEmail
+	}
+
+	addr, err := mail.ParseAddress(email)
+	// Display names ("Name <a@b.c>") and comments are valid in
+	// headers but not as an account's address.
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", errInvalidEmail
+	}
+
+	at := strings.LastIndex(email, "@")
+	domain := email[at+1:]
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", errInvalidEmail
+	}
+
+	return email, nil
+}
+
+// canonicalEmail is the form emails are stored and looked up in.
+func canonicalEmail(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+// handlerAdminBackup streams a consistent snapshot of the database
+// while the server keeps serving requests.
+func (cfg *apiConfig) handlerAdminBackup(w http.ResponseWriter, r *http.Request) {
+	ext := ".json"
+	contentType := "application/json"
+	if _, ok := cfg.DB.(*database.SQLiteDB); ok {
+		ext = ".db"
+		contentType = "application/vnd.sqlite3"
+	}
+
+	filename := fmt.Sprintf("chirpy-backup-%s%s", time.Now().UTC().Format("20060102T150405Z"), ext)
+	bw := &backupWriter{
+		w:           w,
+		contentType: contentType,
+		filename:    filename,
+	}
+	err := cfg.DB.Backup(bw)
+	if err != nil {
+		if !bw.started {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't back up database")
+			return
+		}
+		log.Printf("Error streaming backup: %s", err)
+	}
+}
+
+// backupWriter sends the response headers on the first write,
+// so a backup that fails before producing data can still get
+// a proper error response.
+type backupWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	filename    string
+	started     bool
+}
+
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	if !bw.started {
+		bw.started = true
+		bw.w.Header().Set("Content-Type", bw.contentType)
+		bw.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", bw.filename))
+		bw.w.WriteHeader(http.StatusOK)
+	}
+	return bw.w.Write(p)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+const oauthClientMaxName = 100
+
+// OAuthClient is a registered OAuth client as shown to admins.
+// ClientSecret is only set in the response that creates it.
+type OAuthClient struct {
+	ID           string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+	ClientSecret string    `json:"client_secret,omitempty"`
+}
+
+func oauthClientResponse(client database.OAuthClient) OAuthClient {
+	return OAuthClient{
+		ID:           client.ID,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Confidential: client.Confidential(),
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// handlerAdminOAuthClientsList lists the registered OAuth clients.
+func (cfg *apiConfig) handlerAdminOAuthClientsList(w http.ResponseWriter, r *http.Request) {
+	clients, err := cfg.DB.GetOAuthClients()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get OAuth clients")
+		return
+	}
+
+	response := make([]OAuthClient, 0, len(clients))
+	for _, client := range clients {
+		response = append(response, oauthClientResponse(client))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handlerAdminOAuthClientsCreate registers an OAuth client. Confidential
+// clients (ones with a server to keep a secret on) get a client secret,
+// shown only in this response.
+func (cfg *apiConfig) handlerAdminOAuthClientsCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > oauthClientMaxName {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Name must be 1 to %d characters", oauthClientMaxName))
+		return
+	}
+	if len(params.RedirectURIs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one redirect URI is required")
+		return
+	}
+	redirectURIs := []string{}
+	for _, uri := range params.RedirectURIs {
+		err := validRedirectURI(uri)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid redirect URI %q: %s", uri, err))
+			return
+		}
+		if !slices.Contains(redirectURIs, uri) {
+			redirectURIs = append(redirectURIs, uri)
+		}
+	}
+
+	id, err := auth.NewTokenID()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create client ID")
+		return
+	}
+	client := database.OAuthClient{
+		ID:           id[:32],
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		CreatedAt:    time.Now().UTC(),
+	}
+	secret := ""
+	if params.Confidential {
+		secret, err = auth.NewTokenID()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create client secret")
+			return
+		}
+		client.SecretHash = auth.HashToken(secret)
+	}
+
+	err = cfg.DB.CreateOAuthClient(client)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create OAuth client")
+		return
+	}
+
+	response := oauthClientResponse(client)
+	response.ClientSecret = secret
+	respondWithJSON(w, http.StatusCreated, response)
+}
+
+// handlerAdminOAuthClientsDelete removes an OAuth client. Its pending
+// codes go with it, and the authenticator rejects the access tokens
+// already issued to it.
+func (cfg *apiConfig) handlerAdminOAuthClientsDelete(w http.ResponseWriter, r *http.Request) {
+	err := cfg.DB.DeleteOAuthClient(chi.URLParam(r, "clientID"))
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find OAuth client")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete OAuth client")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validRedirectURI accepts absolute URIs without a fragment or spaces.
+// Plain http is only allowed back to the client's own machine; native
+// apps may use their private-use scheme (com.example.app:/callback).
+func validRedirectURI(uri string) error {
+	if strings.ContainsAny(uri, " \t\r\n") {
+		return errors.New("must not contain spaces")
+	}
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() {
+		return errors.New("must be an absolute URI")
+	}
+	if u.Fragment != "" || strings.Contains(uri, "#") {
+		return errors.New("must not have a fragment")
+	}
+
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return errors.New("must have a host")
+		}
+	case "http":
+		host := u.Hostname()
+		ip := net.ParseIP(host)
+		if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return errors.New("http is only allowed for localhost")
+		}
+	case "javascript", "data", "file", "vbscript":
+		return fmt.Errorf("scheme %s is not allowed", u.Scheme)
+	default:
+		if !strings.Contains(u.Scheme, ".") {
+			return errors.New("custom schemes must be reverse domain names")
+		}
+	}
+	return nil
+}
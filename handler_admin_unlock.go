@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/Bayan2019/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+// handlerAdminUnlockUser clears the failed logins and lockout of a user.
+// The body may name an ip whose failures and lockout are cleared too,
+// for a user locked out along with everyone behind the same address.
+func (cfg *apiConfig) handlerAdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		IP string `json:"ip"`
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	var ip net.IP
+	if params.IP != "" {
+		ip = net.ParseIP(params.IP)
+		if ip == nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid IP address")
+			return
+		}
+	}
+
+	user, err := cfg.DB.GetUser(userID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get user")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+
+	cfg.loginLimiter.Unlock(user.Email)
+	if ip != nil {
+		cfg.loginLimiter.UnlockIP(ip.String())
+	}
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
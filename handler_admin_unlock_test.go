@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAdminUnlockUser(t *testing.T) {
+	const lockedIP = "192.0.2.1"
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		// wantIPLocked is whether lockedIP is still locked out after.
+		wantIPLocked bool
+	}{
+		{name: "no body", body: "", wantStatus: http.StatusOK, wantIPLocked: true},
+		{name: "no ip", body: `{}`, wantStatus: http.StatusOK, wantIPLocked: true},
+		{name: "ip", body: `{"ip":"` + lockedIP + `"}`, wantStatus: http.StatusOK, wantIPLocked: false},
+		{name: "other ip", body: `{"ip":"192.0.2.2"}`, wantStatus: http.StatusOK, wantIPLocked: true},
+		{name: "invalid ip", body: `{"ip":"localhost"}`, wantStatus: http.StatusBadRequest, wantIPLocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			for i := 0; i < auth.DefaultIPLimits.LockoutAfter; i++ {
+				cfg.loginLimiter.Failed(testEmail, lockedIP)
+			}
+
+			router := chi.NewRouter()
+			router.Post("/admin/users/{userID}/unlock", cfg.handlerAdminUnlockUser)
+			req := httptest.NewRequest(http.MethodPost, "/admin/users/1/unlock", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			accountLocked := cfg.loginLimiter.Wait(testEmail, "198.51.100.1") > 0
+			if wantAccountLocked := tt.wantStatus != http.StatusOK; accountLocked != wantAccountLocked {
+				t.Errorf("account locked = %v, want %v", accountLocked, wantAccountLocked)
+			}
+			ipLocked := cfg.loginLimiter.Wait("other@example.com", lockedIP) > 0
+			if ipLocked != tt.wantIPLocked {
+				t.Errorf("IP locked = %v, want %v", ipLocked, tt.wantIPLocked)
+			}
+		})
+	}
+}
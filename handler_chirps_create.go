@@ -4,19 +4,18 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
-
-	// "strconv"
 	"strings"
+
 	// encapsulating all of your database logic in an internal database package
-	// "github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/auth"
 )
 
 // 5. Storage / 1. Storage
 // If the chirp is valid, you should give it a unique id
 type Chirp struct {
-	ID int `json:"id"`
-	// AuthorID int    `json:"author_id"`
-	Body string `json:"body"`
+	ID       int    `json:"id"`
+	AuthorID int    `json:"author_id"`
+	Body     string `json:"body"`
 }
 
 func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request) {
@@ -24,23 +23,12 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 		Body string `json:"body"`
 	}
 
-	// token, err := auth.GetBearerToken(r.Header)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT")
-	// 	return
-	// }
-
-	// subject, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT")
-	// 	return
-	// }
-
-	// userID, err := strconv.Atoi(subject)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Couldn't parse user ID")
-	// 	return
-	// }
+	// The route is wrapped in cfg.authn.RequireScope(auth.ScopeChirpsWrite).
+	user, _ := auth.UserFromContext(r.Context())
+	if cfg.requireVerifiedEmail && user.VerifiedAt == nil {
+		respondWithError(w, http.StatusForbidden, "Verify your email address before chirping")
+		return
+	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
@@ -59,17 +47,16 @@ func (cfg *apiConfig) handlerChirpsCreate(w http.ResponseWriter, r *http.Request
 
 	// 5. Storage / 1. Storage
 	// CreateChirp creates a new chirp and saves it to disk
-	chirp, err := cfg.DB.CreateChirp(cleaned)
-	// chirp, err := cfg.DB.CreateChirp(cleaned, userID)
+	chirp, err := cfg.DB.CreateChirp(cleaned, user.ID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create chirp")
 		return
 	}
 
 	respondWithJSON(w, http.StatusCreated, Chirp{
-		ID: chirp.ID,
-		// AuthorID: chirp.AuthorID,
-		Body: chirp.Body,
+		ID:       chirp.ID,
+		AuthorID: chirp.AuthorID,
+		Body:     chirp.Body,
 	})
 
 	// 4. JSON / 2. JSON
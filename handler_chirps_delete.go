@@ -1,10 +1,12 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
-	// "github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -17,31 +19,23 @@ func (cfg *apiConfig) handlerChirpsDelete(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// token, err := auth.GetBearerToken(r.Header)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT")
-	// 	return
-	// }
-
-	// subject, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Couldn't validate JWT")
-	// 	return
-	// }
-
-	// userID, err := strconv.Atoi(subject)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusBadRequest, "Couldn't parse user ID")
-	// }
-
-	// dbChirp, err := cfg.DB.GetChirp(chirpID)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusNotFound, "Couldn't get chirp")
-	// }
-	// if dbChirp.AuthorID != userID {
-	// 	respondWithError(w, http.StatusForbidden, "You can't delete this chirp")
-	// 	return
-	// }
+	user, _ := auth.UserFromContext(r.Context())
+
+	dbChirp, err := cfg.DB.GetChirp(chirpID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get chirp")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get chirp")
+		return
+	}
+	// Moderators and admins may remove anyone's chirps.
+	canModerate := user.Role == database.RoleModerator || user.Role == database.RoleAdmin
+	if dbChirp.AuthorID != user.ID && !canModerate {
+		respondWithError(w, http.StatusForbidden, "You can't delete this chirp")
+		return
+	}
 
 	err = cfg.DB.DeleteChirp(chirpID)
 	if err != nil {
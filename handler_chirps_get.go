@@ -27,9 +27,9 @@ func (cfg *apiConfig) handlerChirpsGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	respondWithJSON(w, http.StatusOK, Chirp{
-		ID: dbChirp.ID,
-		// AuthorID: dbChirp.AuthorID,
-		Body: dbChirp.Body,
+		ID:       dbChirp.ID,
+		AuthorID: dbChirp.AuthorID,
+		Body:     dbChirp.Body,
 	})
 }
 
@@ -43,15 +43,15 @@ func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// authorID := -1
-	// authorIDString := r.URL.Query().Get("author_id")
-	// if authorIDString != "" {
-	// 	authorID, err = strconv.Atoi(authorIDString)
-	// 	if err != nil {
-	// 		respondWithError(w, http.StatusBadRequest, "Invalid author ID")
-	// 		return
-	// 	}
-	// }
+	authorID := -1
+	authorIDString := r.URL.Query().Get("author_id")
+	if authorIDString != "" {
+		authorID, err = strconv.Atoi(authorIDString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid author ID")
+			return
+		}
+	}
 
 	sortDirection := "asc"
 	sortDirectionParam := r.URL.Query().Get("sort")
@@ -62,14 +62,14 @@ func (cfg *apiConfig) handlerChirpsRetrieve(w http.ResponseWriter, r *http.Reque
 	chirps := []Chirp{}
 	for _, dbChirp := range dbChirps {
 
-		// if authorID != -1 && dbChirp.AuthorID != authorID {
-		// 	continue
-		// }
+		if authorID != -1 && dbChirp.AuthorID != authorID {
+			continue
+		}
 
 		chirps = append(chirps, Chirp{
-			ID: dbChirp.ID,
-			// AuthorID: dbChirp.AuthorID,
-			Body: dbChirp.Body,
+			ID:       dbChirp.ID,
+			AuthorID: dbChirp.AuthorID,
+			Body:     dbChirp.Body,
 		})
 	}
 
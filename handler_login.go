@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
 )
 
 // 6. Authentication / 1. Authentication with Passwords
@@ -16,15 +20,9 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	// This endpoint should accept a new optional expires_in_seconds field
 	// in the request body
 	type parameters struct {
-		Password  string        `json:"password"`
-		Email     string        `json:"email"`
-		ExpiresIn time.Duration `json:"expires_in_seconds"`
-	}
-
-	type response struct {
-		User
-		Token string `json:"token"`
-		// RefreshToken string `json:"refresh_token"`
+		Password         string `json:"password"`
+		Email            string `json:"email"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -36,10 +34,18 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	email := canonicalEmail(params.Email)
+	ip := clientIP(r)
+	if wait := cfg.loginLimiter.Wait(email, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts; try again later")
+		return
+	}
+
 	// 6. Authentication / 1. Authentication with Passwords
 	// you don't have access to an ID here
-	user, err := cfg.DB.GetUserByEmail(params.Email)
-	if err != nil {
+	user, err := cfg.DB.GetUserByEmail(email)
+	if err != nil && !errors.Is(err, database.ErrNotExist) {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
 		return
 	}
@@ -48,34 +54,83 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	// Use the bcrypt.CompareHashAndPassword function
 	// to compare the password that the user entered in the HTTP request
 	// with the password that is stored in the database.
-	err = auth.CheckPasswordHash(params.Password, user.HashedPassword)
+	// Unknown users get the same work and the same answer as a wrong
+	// password, so logins don't reveal which accounts exist.
+	if err == nil {
+		err = auth.CheckPasswordHash(params.Password, user.HashedPassword)
+	} else {
+		auth.CheckDummyPasswordHash(params.Password)
+	}
 	// 6. Authentication / 1. Authentication with Passwords
 	// If the passwords do not match, return a 401 Unauthorized response.
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid password")
+		cfg.loginLimiter.Failed(email, ip)
+		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password")
 		return
 	}
 
+	// The password is known right now, so this is the moment to move
+	// its hash to the current algorithm and parameters.
+	if auth.PasswordNeedsRehash(user.HashedPassword) {
+		cfg.rehashPassword(user, params.Password)
+	}
+	// Accounts with two-factor authentication get a challenge instead
+	// of tokens. Their failure count is only cleared once the second
+	// factor is right too, so the password can't be used to reset it
+	// between guesses at the code.
+	challenged, ok := cfg.respondWithMFAChallenge(w, user)
+	if challenged || !ok {
+		return
+	}
+	cfg.loginLimiter.Succeeded(email)
+
+	cfg.respondWithLogin(w, r, user, params.ExpiresInSeconds)
+}
+
+// rehashPassword replaces the stored hash of user's password. Failing
+// to do so doesn't fail the login; it is tried again next time.
+func (cfg *apiConfig) rehashPassword(user database.User, password string) {
+	hashedPassword, err := auth.HashPassword(password)
+	if err == nil {
+		_, err = cfg.DB.UpdateUser(user.ID, user.Email, hashedPassword)
+	}
+	if err != nil {
+		log.Printf("Error rehashing password of user %d: %s", user.ID, err)
+	}
+}
+
+// respondWithLogin starts a session for user and responds with the
+// user and their access and refresh tokens.
+func (cfg *apiConfig) respondWithLogin(w http.ResponseWriter, r *http.Request, user database.User, expiresInSeconds int) {
+	type response struct {
+		User
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
 	// 6. Authentication / 6. Authentication with JWTs
 	// expires_in_seconds is an optional parameter.
 	// If it's specified by the client, use it as the expiration time.
 	// If it's not specified, use a default expiration time of 24 hours.
 	// If the client specified a number over 24 hours,
 	// use 24 hours as the expiration time.
-	if params.ExpiresIn == 0 || params.ExpiresIn > 24*time.Hour {
-		params.ExpiresIn = 24 * time.Hour
+	// Now that sessions are kept alive with refresh tokens,
+	// access tokens last at most accessTokenTTL.
+	expiresIn := time.Duration(expiresInSeconds) * time.Second
+	if expiresIn <= 0 || expiresIn > accessTokenTTL {
+		expiresIn = accessTokenTTL
 	}
-	accessToken, err := auth.MakeJWT(user.ID, cfg.jwtSecret, params.ExpiresIn, auth.TokenTypeAccess)
+	refreshToken, sessionID, err := cfg.issueRefreshToken(r, user.ID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh JWT")
 		return
 	}
 
-	// refreshToken, err := auth.MakeJWT(user.ID, cfg.jwtSecret, time.Hour*24*30*6, auth.TokenTypeRefresh)
-	// if err != nil {
-	// 	respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh JWT")
-	// 	return
-	// }
+	accessToken, err := auth.MakeAccessJWT(user.ID, sessionID, cfg.jwtKeys, expiresIn)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT")
+		return
+	}
 
 	// 6. Authentication / 1. Authentication with Passwords
 	// If the passwords match, return a 200 OK response and a copy of the user resource
@@ -83,10 +138,13 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	// Once you have the token, respond to the request with a 200 code and token
 	respondWithJSON(w, http.StatusOK, response{
 		User: User{
-			ID:    user.ID,
-			Email: user.Email,
+			ID:         user.ID,
+			Email:      user.Email,
+			Role:       user.Role,
+			VerifiedAt: user.VerifiedAt,
 		},
-		Token: accessToken,
+		Token:        accessToken,
+		RefreshToken: refreshToken,
 	})
 	// respondWithJSON(w, http.StatusOK, Response{
 	// 	User: User{
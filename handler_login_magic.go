@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+	"github.com/Bayan2019/chirpy/internal/mailer"
+	"github.com/go-chi/chi/v5"
+)
+
+const magicLinkTTL = 15 * time.Minute
+
+// handlerLoginMagicRequest mails a single-use login link to the user
+// with the given email, for logging in without a password. Like
+// password reset requests, it answers the same way whether or not the
+// user exists.
+// The stdout mailer (MAILER=file without MAIL_FILE) prints the link
+// into the logs, so it is for local development only.
+func (cfg *apiConfig) handlerLoginMagicRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	email := canonicalEmail(params.Email)
+	ip := clientIP(r)
+	if wait := cfg.magicLinkLimiter.Wait(email, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		respondWithError(w, http.StatusTooManyRequests, "Too many login links requested; try again later")
+		return
+	}
+	cfg.magicLinkLimiter.Failed(email, ip)
+
+	user, err := cfg.DB.GetUserByEmail(email)
+	if err != nil && !errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	if err == nil {
+		go func() {
+			err := cfg.sendMagicLink(user)
+			if err != nil {
+				log.Printf("Error sending login link to user %d: %s", user.ID, err)
+			}
+		}()
+	}
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+// sendMagicLink mails user a login link. The token in it isn't signed:
+// it is 256 random bits, stored only as a hash, that the server expires
+// and deletes on first use. A signature would add nothing to that, and
+// a self-contained signed token couldn't be made single-use without
+// keeping server-side state anyway.
+func (cfg *apiConfig) sendMagicLink(user database.User) error {
+	token, err := auth.NewTokenID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	err = cfg.DB.CreateUserToken(database.UserToken{
+		Hash:      auth.HashToken(token),
+		UserID:    user.ID,
+		Purpose:   database.TokenPurposeMagicLogin,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(magicLinkTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/api/login/magic/%s", cfg.publicURL, token)
+	return cfg.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy login link",
+		Body: fmt.Sprintf("Open this link to log in to Chirpy:\n\n    %s\n\n"+
+			"The link works once within the next %d minutes. If you didn't ask for it, you can ignore this email.\n",
+			link, int(magicLinkTTL.Minutes())),
+	})
+}
+
+// handlerLoginMagicConfirm is where login links lead. Mail scanners
+// and link previews fetch links on their own, so following one only
+// shows a page asking the user to log in; the token is used by the
+// POST that page sends.
+func (cfg *apiConfig) handlerLoginMagicConfirm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	w.WriteHeader(http.StatusOK)
+	err := magicLinkTemplate.Execute(w, nil)
+	if err != nil {
+		log.Printf("Error rendering login link page: %s", err)
+	}
+}
+
+var magicLinkTemplate = template.Must(template.New("magic").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Chirpy</title>
+</head>
+<body>
+<h1>Log in to Chirpy</h1>
+<p>The link works once. Only continue if you asked for it.</p>
+<form method="post">
+<p><button type="submit">Log in</button></p>
+</form>
+</body>
+</html>
+`))
+
+// handlerLoginMagic logs in with the token from a login link and
+// responds like POST /api/login: with tokens, or with an MFA challenge
+// for accounts with two-factor authentication. Using the link proves
+// the user owns their email address, so it is verified too.
+func (cfg *apiConfig) handlerLoginMagic(w http.ResponseWriter, r *http.Request) {
+	userToken, err := cfg.DB.ConsumeUserToken(auth.HashToken(chi.URLParam(r, "token")), database.TokenPurposeMagicLogin)
+	if errors.Is(err, database.ErrNotExist) || errors.Is(err, database.ErrTokenExpired) {
+		respondWithError(w, http.StatusUnauthorized, "Login link is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check login link")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userToken.UserID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "Login link is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	// The user changed their email after the link was sent.
+	if user.Email != userToken.Email {
+		respondWithError(w, http.StatusUnauthorized, "Login link is invalid or expired")
+		return
+	}
+	cfg.magicLinkLimiter.Succeeded(user.Email)
+
+	if user.VerifiedAt == nil {
+		user, err = cfg.DB.VerifyUser(user.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't verify user")
+			return
+		}
+	}
+
+	challenged, ok := cfg.respondWithMFAChallenge(w, user)
+	if challenged || !ok {
+		return
+	}
+
+	cfg.respondWithLogin(w, r, user, 0)
+}
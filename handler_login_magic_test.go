@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestLoginMagicLink(t *testing.T) {
+	cfg := newTestConfig(t)
+	user, err := cfg.DB.GetUserByEmail(testEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.NewTokenID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	err = cfg.DB.CreateUserToken(database.UserToken{
+		Hash:      auth.HashToken(token),
+		UserID:    user.ID,
+		Purpose:   database.TokenPurposeMagicLogin,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(magicLinkTTL),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/api/login/magic/{token}", cfg.handlerLoginMagicConfirm)
+	router.Post("/api/login/magic/{token}", cfg.handlerLoginMagic)
+	follow := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/login/magic/"+token, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Opening the link, as a mail scanner would, twice.
+	for i := 0; i < 2; i++ {
+		rec := follow(http.MethodGet)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET: got status %d, want %d", rec.Code, http.StatusOK)
+		}
+	}
+
+	rec := follow(http.MethodPost)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST after GET: got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	rec = follow(http.MethodPost)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("second POST: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+// mfaChallenge is the login response for accounts with two-factor
+// authentication; MFAToken is exchanged at POST /api/login/mfa.
+type mfaChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// respondWithMFAChallenge responds with an MFA challenge if user has
+// two-factor authentication enabled, and reports whether it did. It
+// returns false for ok if it responded with an error instead.
+func (cfg *apiConfig) respondWithMFAChallenge(w http.ResponseWriter, user database.User) (challenged, ok bool) {
+	totp, err := cfg.DB.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings")
+		return false, false
+	}
+	if err != nil || !totp.Enabled() {
+		return false, true
+	}
+
+	mfaToken, err := auth.MakeJWT(user.ID, cfg.jwtKeys, mfaChallengeTTL, auth.TokenTypeMFA)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create MFA JWT")
+		return false, false
+	}
+	respondWithJSON(w, http.StatusOK, mfaChallenge{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	})
+	return true, true
+}
+
+var errBadSecondFactor = errors.New("invalid two-factor code")
+
+// checkSecondFactor accepts either a current TOTP code or an unused
+// recovery code for user, and uses it up.
+func (cfg *apiConfig) checkSecondFactor(totp database.TOTP, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		err := cfg.DB.UseRecoveryCode(totp.UserID, auth.HashRecoveryCode(recoveryCode))
+		if errors.Is(err, database.ErrNotExist) {
+			return errBadSecondFactor
+		}
+		return err
+	}
+
+	step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return errBadSecondFactor
+	}
+	err := cfg.DB.UseTOTPStep(totp.UserID, step)
+	if errors.Is(err, database.ErrTokenReused) {
+		return errBadSecondFactor
+	}
+	return err
+}
+
+// handlerLoginMFA finishes a login for an account with two-factor
+// authentication: the challenge token from POST /api/login plus a
+// TOTP code or a recovery code are exchanged for the real tokens.
+func (cfg *apiConfig) handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken         string `json:"mfa_token"`
+		Code             string `json:"code"`
+		RecoveryCode     string `json:"recovery_code"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	claims, err := auth.ValidateJWT(params.MFAToken, cfg.jwtKeys, auth.TokenTypeMFA)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate MFA JWT")
+		return
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate MFA JWT")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate MFA JWT")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+
+	ip := clientIP(r)
+	if wait := cfg.loginLimiter.Wait(user.Email, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts; try again later")
+		return
+	}
+
+	totp, err := cfg.DB.GetTOTP(user.ID)
+	if errors.Is(err, database.ErrNotExist) || (err == nil && !totp.Enabled()) {
+		// Two-factor authentication was turned off meanwhile.
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate MFA JWT")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings")
+		return
+	}
+
+	err = cfg.checkSecondFactor(totp, params.Code, params.RecoveryCode)
+	if errors.Is(err, errBadSecondFactor) {
+		cfg.loginLimiter.Failed(user.Email, ip)
+		respondWithError(w, http.StatusUnauthorized, "Invalid two-factor code")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check two-factor code")
+		return
+	}
+	cfg.loginLimiter.Succeeded(user.Email)
+
+	cfg.respondWithLogin(w, r, user, params.ExpiresInSeconds)
+}
+
+// handlerTOTPEnroll starts two-factor enrollment with a new secret.
+// It has no effect on logins until confirmed.
+func (cfg *apiConfig) handlerTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+
+	user, _ := auth.UserFromContext(r.Context())
+
+	existing, err := cfg.DB.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings")
+		return
+	}
+	if err == nil && existing.Enabled() {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create secret")
+		return
+	}
+	err = cfg.DB.SaveTOTP(database.TOTP{
+		UserID: user.ID,
+		Secret: secret,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save two-factor settings")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		Secret: secret,
+		URI:    auth.TOTPURI(secret, user.Email),
+	})
+}
+
+// handlerTOTPConfirm turns two-factor authentication on once the user
+// shows a code from their app, and hands out the recovery codes.
+// They are only ever shown here.
+func (cfg *apiConfig) handlerTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	user, _ := auth.UserFromContext(r.Context())
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	totp, err := cfg.DB.GetTOTP(user.ID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Start two-factor enrollment first")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings")
+		return
+	}
+	if totp.Enabled() {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(totp.Secret, params.Code, time.Now())
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid two-factor code")
+		return
+	}
+
+	codes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create recovery codes")
+		return
+	}
+
+	now := time.Now().UTC()
+	totp.ConfirmedAt = &now
+	totp.LastStep = step
+	totp.RecoveryCodes = make([]string, 0, len(codes))
+	for _, code := range codes {
+		totp.RecoveryCodes = append(totp.RecoveryCodes, auth.HashRecoveryCode(code))
+	}
+	err = cfg.DB.SaveTOTP(totp)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save two-factor settings")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		RecoveryCodes: codes,
+	})
+}
+
+// handlerTOTPDisable turns two-factor authentication off; it takes a
+// current code or a recovery code.
+func (cfg *apiConfig) handlerTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	user, _ := auth.UserFromContext(r.Context())
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	totp, err := cfg.DB.GetTOTP(user.ID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Two-factor authentication is not enabled")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get two-factor settings")
+		return
+	}
+
+	// A pending enrollment can be dropped without a code.
+	if totp.Enabled() {
+		if user.Role != database.RoleUser {
+			respondWithError(w, http.StatusForbidden, "Moderators and admins must keep two-factor authentication on")
+			return
+		}
+
+		ip := clientIP(r)
+		if wait := cfg.loginLimiter.Wait(user.Email, ip); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+			respondWithError(w, http.StatusTooManyRequests, "Too many failed attempts; try again later")
+			return
+		}
+
+		err = cfg.checkSecondFactor(totp, params.Code, params.RecoveryCode)
+		if errors.Is(err, errBadSecondFactor) {
+			cfg.loginLimiter.Failed(user.Email, ip)
+			respondWithError(w, http.StatusBadRequest, "Invalid two-factor code")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check two-factor code")
+			return
+		}
+	}
+
+	err = cfg.DB.DeleteTOTP(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save two-factor settings")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+const oauthCodeTTL = 5 * time.Minute
+
+// scopeDescriptions tell the user on the consent page what a client
+// asking for each scope can do.
+var scopeDescriptions = map[string]string{
+	auth.ScopeOpenID:      "Know who you are on Chirpy",
+	auth.ScopeEmail:       "See your email address",
+	auth.ScopeChirpsRead:  "Read chirps",
+	auth.ScopeChirpsWrite: "Post and delete chirps as you",
+	auth.ScopeUsersRead:   "Export your account data, including your chirps and sessions",
+}
+
+// authorizeRequest is a validated authorization request.
+type authorizeRequest struct {
+	Client        database.OAuthClient
+	RedirectURI   string
+	State         string
+	Scopes        []string
+	CodeChallenge string
+	Nonce         string
+}
+
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// parseAuthorizeRequest validates the authorization request in r.
+// Without a known client and one of its redirect URIs there is nowhere
+// safe to send errors, so those are shown to the user; anything else
+// is reported back to the client. Either way it has responded when it
+// returns false.
+func (cfg *apiConfig) parseAuthorizeRequest(w http.ResponseWriter, r *http.Request) (authorizeRequest, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		cfg.renderAuthorizeError(w, http.StatusBadRequest, "The authorization request is malformed.")
+		return authorizeRequest{}, false
+	}
+
+	client, err := cfg.DB.GetOAuthClient(r.Form.Get("client_id"))
+	if errors.Is(err, database.ErrNotExist) {
+		cfg.renderAuthorizeError(w, http.StatusBadRequest, "The application asking for access isn't registered with Chirpy.")
+		return authorizeRequest{}, false
+	}
+	if err != nil {
+		cfg.renderAuthorizeError(w, http.StatusInternalServerError, "Something went wrong. Please try again later.")
+		return authorizeRequest{}, false
+	}
+	req := authorizeRequest{
+		Client:        client,
+		RedirectURI:   r.Form.Get("redirect_uri"),
+		State:         r.Form.Get("state"),
+		CodeChallenge: r.Form.Get("code_challenge"),
+		Nonce:         r.Form.Get("nonce"),
+	}
+	if !client.HasRedirectURI(req.RedirectURI) {
+		cfg.renderAuthorizeError(w, http.StatusBadRequest, "The application asked to be sent back to an address it didn't register.")
+		return authorizeRequest{}, false
+	}
+
+	if r.Form.Get("response_type") != "code" {
+		cfg.redirectWithOAuthError(w, r, req, "unsupported_response_type", "response_type must be code")
+		return authorizeRequest{}, false
+	}
+	for _, scope := range strings.Fields(r.Form.Get("scope")) {
+		if !auth.ValidOAuthScope(scope) {
+			cfg.redirectWithOAuthError(w, r, req, "invalid_scope", "Unknown scope "+scope)
+			return authorizeRequest{}, false
+		}
+		if !slices.Contains(req.Scopes, scope) {
+			req.Scopes = append(req.Scopes, scope)
+		}
+	}
+	if len(req.Scopes) == 0 {
+		cfg.redirectWithOAuthError(w, r, req, "invalid_scope", "scope is required")
+		return authorizeRequest{}, false
+	}
+	if slices.Contains(req.Scopes, auth.ScopeOpenID) && !cfg.jwtKeys.CanSignPublicly() {
+		cfg.redirectWithOAuthError(w, r, req, "invalid_scope", "openid isn't available on this server")
+		return authorizeRequest{}, false
+	}
+	if r.Form.Get("code_challenge_method") != auth.PKCEMethodS256 || !codeChallengePattern.MatchString(req.CodeChallenge) {
+		cfg.redirectWithOAuthError(w, r, req, "invalid_request", "PKCE with code_challenge_method S256 is required")
+		return authorizeRequest{}, false
+	}
+	return req, true
+}
+
+// handlerOAuthAuthorize shows the page where the user signs in and
+// decides whether to let the client act on their behalf.
+func (cfg *apiConfig) handlerOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	req, ok := cfg.parseAuthorizeRequest(w, r)
+	if !ok {
+		return
+	}
+	cfg.renderAuthorize(w, http.StatusOK, req, "", "")
+}
+
+// handlerOAuthAuthorizeSubmit handles the consent page. If the user
+// allows access and their credentials check out, the client gets an
+// authorization code for its token endpoint request.
+func (cfg *apiConfig) handlerOAuthAuthorizeSubmit(w http.ResponseWriter, r *http.Request) {
+	req, ok := cfg.parseAuthorizeRequest(w, r)
+	if !ok {
+		return
+	}
+	if r.PostForm.Get("action") != "allow" {
+		cfg.redirectWithOAuthError(w, r, req, "access_denied", "The user denied access")
+		return
+	}
+
+	email := canonicalEmail(r.PostForm.Get("email"))
+	password := r.PostForm.Get("password")
+	ip := clientIP(r)
+	if wait := cfg.loginLimiter.Wait(email, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		cfg.renderAuthorize(w, http.StatusTooManyRequests, req, email, "Too many failed attempts; try again later.")
+		return
+	}
+
+	// Same checks as POST /api/login, so this page is no easier to
+	// guess passwords through.
+	user, err := cfg.DB.GetUserByEmail(email)
+	if err != nil && !errors.Is(err, database.ErrNotExist) {
+		cfg.renderAuthorize(w, http.StatusInternalServerError, req, email, "Something went wrong. Please try again.")
+		return
+	}
+	if err == nil {
+		err = auth.CheckPasswordHash(password, user.HashedPassword)
+	} else {
+		auth.CheckDummyPasswordHash(password)
+	}
+	if err != nil {
+		cfg.loginLimiter.Failed(email, ip)
+		cfg.renderAuthorize(w, http.StatusUnauthorized, req, email, "Incorrect email or password.")
+		return
+	}
+
+	totp, err := cfg.DB.GetTOTP(user.ID)
+	if err != nil && !errors.Is(err, database.ErrNotExist) {
+		cfg.renderAuthorize(w, http.StatusInternalServerError, req, email, "Something went wrong. Please try again.")
+		return
+	}
+	if err == nil && totp.Enabled() {
+		code := strings.TrimSpace(r.PostForm.Get("code"))
+		if code == "" {
+			cfg.renderAuthorize(w, http.StatusUnauthorized, req, email, "Enter the code from your authenticator app or a recovery code.")
+			return
+		}
+		// Six digits are a TOTP code; anything else a recovery code.
+		if len(code) == 6 && strings.Trim(code, "0123456789") == "" {
+			err = cfg.checkSecondFactor(totp, code, "")
+		} else {
+			err = cfg.checkSecondFactor(totp, "", code)
+		}
+		if errors.Is(err, errBadSecondFactor) {
+			cfg.loginLimiter.Failed(email, ip)
+			cfg.renderAuthorize(w, http.StatusUnauthorized, req, email, "Invalid two-factor code.")
+			return
+		}
+		if err != nil {
+			cfg.renderAuthorize(w, http.StatusInternalServerError, req, email, "Something went wrong. Please try again.")
+			return
+		}
+	}
+	cfg.loginLimiter.Succeeded(email)
+	if auth.PasswordNeedsRehash(user.HashedPassword) {
+		cfg.rehashPassword(user, password)
+	}
+
+	code, err := auth.NewTokenID()
+	if err != nil {
+		cfg.redirectWithOAuthError(w, r, req, "server_error", "Couldn't create authorization code")
+		return
+	}
+	now := time.Now().UTC()
+	err = cfg.DB.CreateOAuthCode(database.OAuthCode{
+		Hash:          auth.HashToken(code),
+		ClientID:      req.Client.ID,
+		UserID:        user.ID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        req.Scopes,
+		CodeChallenge: req.CodeChallenge,
+		Nonce:         req.Nonce,
+		AuthTime:      now,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(oauthCodeTTL),
+	})
+	if err != nil {
+		log.Printf("Error storing authorization code: %s", err)
+		cfg.redirectWithOAuthError(w, r, req, "server_error", "Couldn't create authorization code")
+		return
+	}
+
+	cfg.redirectToClient(w, r, req, url.Values{"code": {code}})
+}
+
+// redirectWithOAuthError sends an error back to the client.
+func (cfg *apiConfig) redirectWithOAuthError(w http.ResponseWriter, r *http.Request, req authorizeRequest, code, description string) {
+	cfg.redirectToClient(w, r, req, url.Values{
+		"error":             {code},
+		"error_description": {description},
+	})
+}
+
+// redirectToClient sends the user back to the client's redirect URI
+// with params, the client's state and our issuer identifier added to
+// its query.
+func (cfg *apiConfig) redirectToClient(w http.ResponseWriter, r *http.Request, req authorizeRequest, params url.Values) {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		cfg.renderAuthorizeError(w, http.StatusInternalServerError, "Something went wrong. Please try again later.")
+		return
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	query.Set("iss", cfg.publicURL)
+	u.RawQuery = query.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Chirpy</title>
+</head>
+<body>
+{{if .Request}}
+<h1>{{.Request.Client.Name}} wants to use your Chirpy account</h1>
+<p>If you allow it, {{.Request.Client.Name}} will be able to:</p>
+<ul>
+{{range .Scopes}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .Error}}<p role="alert"><strong>{{.Error}}</strong></p>{{end}}
+<form method="post">
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="client_id" value="{{.Request.Client.ID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="S256">
+<p><label>Email <input type="email" name="email" value="{{.Email}}" autocomplete="username"></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password"></label></p>
+<p><label>Two-factor or recovery code, if you use one <input type="text" name="code" autocomplete="one-time-code"></label></p>
+<p>
+<button type="submit" name="action" value="allow">Allow</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</p>
+</form>
+{{else}}
+<h1>Can't continue</h1>
+<p>{{.Error}}</p>
+{{end}}
+</body>
+</html>
+`))
+
+// renderAuthorize shows the sign-in and consent page for req, with
+// email filled in and an error message if set.
+func (cfg *apiConfig) renderAuthorize(w http.ResponseWriter, code int, req authorizeRequest, email, errorMessage string) {
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		scopes = append(scopes, scopeDescriptions[scope])
+	}
+	cfg.renderAuthorizePage(w, code, map[string]any{
+		"Request": &req,
+		"Scope":   strings.Join(req.Scopes, " "),
+		"Scopes":  scopes,
+		"Email":   email,
+		"Error":   errorMessage,
+	})
+}
+
+// renderAuthorizeError shows an error to the user instead of sending
+// them back to a client that can't be trusted.
+func (cfg *apiConfig) renderAuthorizeError(w http.ResponseWriter, code int, message string) {
+	cfg.renderAuthorizePage(w, code, map[string]any{"Error": message})
+}
+
+func (cfg *apiConfig) renderAuthorizePage(w http.ResponseWriter, code int, data map[string]any) {
+	// The page takes passwords, so it mustn't be framed or cached.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+	w.WriteHeader(code)
+	err := authorizeTemplate.Execute(w, data)
+	if err != nil {
+		log.Printf("Error rendering authorize page: %s", err)
+	}
+}
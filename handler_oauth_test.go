@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+const (
+	testOAuthRedirectURI = "https://client.example.com/callback"
+	testPKCEVerifier     = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// newTestOAuthConfig returns a test server with one public OAuth
+// client.
+func newTestOAuthConfig(t *testing.T) (*apiConfig, database.OAuthClient) {
+	t.Helper()
+	cfg := newTestConfig(t)
+	client := database.OAuthClient{
+		ID:           "test-client",
+		Name:         "Test client",
+		RedirectURIs: []string{testOAuthRedirectURI},
+		CreatedAt:    time.Now().UTC(),
+	}
+	err := cfg.DB.CreateOAuthClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, client
+}
+
+// authorizeTestClient signs in on the consent page, allows access and
+// returns the authorization code the client is sent back with.
+func authorizeTestClient(t *testing.T, cfg *apiConfig, client database.OAuthClient, verifier string) string {
+	t.Helper()
+	form := url.Values{
+		"client_id":             {client.ID},
+		"redirect_uri":          {testOAuthRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {auth.ScopeChirpsRead},
+		"state":                 {"xyz"},
+		"code_challenge":        {auth.PKCEChallenge(verifier)},
+		"code_challenge_method": {auth.PKCEMethodS256},
+		"action":                {"allow"},
+		"email":                 {testEmail},
+		"password":              {testPassword},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	cfg.handlerOAuthAuthorizeSubmit(rec, req)
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("authorize: got status %d, want %d: %s", rec.Code, http.StatusFound, rec.Body)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("state") != "xyz" {
+		t.Errorf("authorize: got state %q, want %q", query.Get("state"), "xyz")
+	}
+	code := query.Get("code")
+	if code == "" {
+		t.Fatalf("authorize: no code in redirect to %s", location)
+	}
+	return code
+}
+
+// exchangeTestCode calls the token endpoint for code.
+func exchangeTestCode(cfg *apiConfig, client database.OAuthClient, code, verifier string) *httptest.ResponseRecorder {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"code":          {code},
+		"redirect_uri":  {testOAuthRedirectURI},
+		"code_verifier": {verifier},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	cfg.handlerOAuthToken(rec, req)
+	return rec
+}
+
+func decodeOAuthError(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	res := oauthError{}
+	err := json.NewDecoder(rec.Body).Decode(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Error
+}
+
+func TestOAuthTokenExchange(t *testing.T) {
+	t.Run("wrong code_verifier", func(t *testing.T) {
+		cfg, client := newTestOAuthConfig(t)
+		code := authorizeTestClient(t, cfg, client, testPKCEVerifier)
+
+		rec := exchangeTestCode(cfg, client, code, strings.Repeat("a", 43))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+		}
+		if got := decodeOAuthError(t, rec); got != "invalid_grant" {
+			t.Errorf("got error %q, want invalid_grant", got)
+		}
+
+		// A guess burns the code, so the right verifier is too late.
+		rec = exchangeTestCode(cfg, client, code, testPKCEVerifier)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("code still works after a wrong verifier: status %d", rec.Code)
+		}
+	})
+
+	t.Run("replayed code", func(t *testing.T) {
+		cfg, client := newTestOAuthConfig(t)
+		code := authorizeTestClient(t, cfg, client, testPKCEVerifier)
+
+		rec := exchangeTestCode(cfg, client, code, testPKCEVerifier)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+		}
+		rec = exchangeTestCode(cfg, client, code, testPKCEVerifier)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("replay: got status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+		}
+		if got := decodeOAuthError(t, rec); got != "invalid_grant" {
+			t.Errorf("replay: got error %q, want invalid_grant", got)
+		}
+	})
+
+	t.Run("deleted client", func(t *testing.T) {
+		cfg, client := newTestOAuthConfig(t)
+		code := authorizeTestClient(t, cfg, client, testPKCEVerifier)
+		rec := exchangeTestCode(cfg, client, code, testPKCEVerifier)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+		}
+		res := struct {
+			AccessToken string `json:"access_token"`
+		}{}
+		err := json.NewDecoder(rec.Body).Decode(&res)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler := cfg.authn.RequireScope(auth.ScopeChirpsRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		readChirps := func() int {
+			req := httptest.NewRequest(http.MethodGet, "/api/chirps", nil)
+			req.Header.Set("Authorization", "Bearer "+res.AccessToken)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		if code := readChirps(); code != http.StatusOK {
+			t.Fatalf("got status %d before deleting the client, want %d", code, http.StatusOK)
+		}
+		err = cfg.DB.DeleteOAuthClient(client.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := readChirps(); code != http.StatusUnauthorized {
+			t.Errorf("got status %d after deleting the client, want %d", code, http.StatusUnauthorized)
+		}
+	})
+}
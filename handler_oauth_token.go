@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+// oauthError is the error response of the token endpoint (RFC 6749
+// section 5.2).
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func respondWithOAuthError(w http.ResponseWriter, code int, errorCode, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, oauthError{
+		Error:       errorCode,
+		Description: description,
+	})
+}
+
+// handlerOAuthToken exchanges an authorization code for an access token
+// limited to the scopes the user granted and, with the openid scope,
+// an ID token. OAuth clients get no refresh tokens; they send the user
+// through /oauth/authorize again.
+func (cfg *apiConfig) handlerOAuthToken(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		Scope       string `json:"scope"`
+		IDToken     string `json:"id_token,omitempty"`
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_request", "Couldn't parse the request body")
+		return
+	}
+
+	client, ok := cfg.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+	if grantType := r.PostForm.Get("grant_type"); grantType != "authorization_code" {
+		respondWithOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code")
+		return
+	}
+
+	code, err := cfg.DB.ConsumeOAuthCode(auth.HashToken(r.PostForm.Get("code")))
+	if errors.Is(err, database.ErrNotExist) || errors.Is(err, database.ErrTokenExpired) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "The authorization code is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't check the authorization code")
+		return
+	}
+	if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "The authorization code was issued to another client or redirect URI")
+		return
+	}
+	if !auth.CheckPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match the code challenge")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(code.UserID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithOAuthError(w, http.StatusBadRequest, "invalid_grant", "The user no longer exists")
+		return
+	}
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't get user")
+		return
+	}
+
+	accessToken, err := auth.MakeOAuthAccessJWT(user.ID, client.ID, code.Scopes, cfg.jwtKeys, accessTokenTTL)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't create access token")
+		return
+	}
+
+	idToken := ""
+	if slices.Contains(code.Scopes, auth.ScopeOpenID) {
+		claims := auth.IDTokenClaims{
+			AuthTime: code.AuthTime.Unix(),
+			Nonce:    code.Nonce,
+		}
+		if slices.Contains(code.Scopes, auth.ScopeEmail) {
+			verified := user.VerifiedAt != nil
+			claims.Email = user.Email
+			claims.EmailVerified = &verified
+		}
+		idToken, err = auth.MakeIDToken(cfg.jwtKeys, cfg.publicURL, client.ID, user.ID, accessTokenTTL, claims)
+		if err != nil {
+			log.Printf("Error creating ID token: %s", err)
+			respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't create ID token")
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, response{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(accessTokenTTL.Seconds()),
+		Scope:       strings.Join(code.Scopes, " "),
+		IDToken:     idToken,
+	})
+}
+
+// authenticateOAuthClient identifies the client calling the token
+// endpoint, by HTTP Basic authentication or client_id and client_secret
+// form fields. Confidential clients must prove they know their secret.
+func (cfg *apiConfig) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (database.OAuthClient, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// Basic credentials are form-encoded first (RFC 6749 section 2.3.1).
+		var errID, errSecret error
+		clientID, errID = url.QueryUnescape(clientID)
+		secret, errSecret = url.QueryUnescape(secret)
+		if errID != nil || errSecret != nil {
+			cfg.invalidClient(w, basic)
+			return database.OAuthClient{}, false
+		}
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := cfg.DB.GetOAuthClient(clientID)
+	if errors.Is(err, database.ErrNotExist) {
+		cfg.invalidClient(w, basic)
+		return database.OAuthClient{}, false
+	}
+	if err != nil {
+		respondWithOAuthError(w, http.StatusInternalServerError, "server_error", "Couldn't get client")
+		return database.OAuthClient{}, false
+	}
+	if client.Confidential() &&
+		subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(client.SecretHash)) != 1 {
+		cfg.invalidClient(w, basic)
+		return database.OAuthClient{}, false
+	}
+	return client, true
+}
+
+func (cfg *apiConfig) invalidClient(w http.ResponseWriter, basic bool) {
+	if basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	}
+	respondWithOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+}
+
+// handlerOAuthUserinfo is the OpenID Connect userinfo endpoint. The
+// email is only included for tokens holding the email scope.
+func (cfg *apiConfig) handlerOAuthUserinfo(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email,omitempty"`
+		EmailVerified *bool  `json:"email_verified,omitempty"`
+	}
+
+	user, _ := auth.UserFromContext(r.Context())
+	claims, _ := auth.ClaimsFromContext(r.Context())
+
+	res := response{Subject: claims.Subject}
+	if claims.ClientID == "" || claims.HasScope(auth.ScopeEmail) {
+		verified := user.VerifiedAt != nil
+		res.Email = user.Email
+		res.EmailVerified = &verified
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// handlerOpenIDConfiguration publishes the OpenID Connect discovery
+// document, so clients can configure themselves from the issuer URL.
+func (cfg *apiConfig) handlerOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Issuer                            string   `json:"issuer"`
+		AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+		TokenEndpoint                     string   `json:"token_endpoint"`
+		UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+		JWKSURI                           string   `json:"jwks_uri"`
+		ResponseTypesSupported            []string `json:"response_types_supported"`
+		SubjectTypesSupported             []string `json:"subject_types_supported"`
+		IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+		ScopesSupported                   []string `json:"scopes_supported"`
+		TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+		ClaimsSupported                   []string `json:"claims_supported"`
+		CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+		GrantTypesSupported               []string `json:"grant_types_supported"`
+		AuthorizationResponseIssParameter bool     `json:"authorization_response_iss_parameter_supported"`
+	}
+
+	scopes := auth.OAuthScopes
+	algorithms := []string{}
+	if cfg.jwtKeys.CanSignPublicly() {
+		algorithms = append(algorithms, cfg.jwtKeys.SigningAlgorithm())
+	} else {
+		scopes = slices.DeleteFunc(slices.Clone(scopes), func(scope string) bool {
+			return scope == auth.ScopeOpenID
+		})
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, response{
+		Issuer:                            cfg.publicURL,
+		AuthorizationEndpoint:             cfg.publicURL + "/oauth/authorize",
+		TokenEndpoint:                     cfg.publicURL + "/oauth/token",
+		UserinfoEndpoint:                  cfg.publicURL + "/oauth/userinfo",
+		JWKSURI:                           cfg.publicURL + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  algorithms,
+		ScopesSupported:                   scopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified"},
+		CodeChallengeMethodsSupported:     []string{auth.PKCEMethodS256},
+		GrantTypesSupported:               []string{"authorization_code"},
+		AuthorizationResponseIssParameter: true,
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+	"github.com/Bayan2019/chirpy/internal/mailer"
+)
+
+const passwordResetTTL = time.Hour
+
+// handlerPasswordResetRequest mails a reset token to the user with the
+// given email. It answers the same way whether or not the user exists,
+// so it can't be used to find out who has an account.
+// With MAILER=file and no MAIL_FILE the token is printed to stdout,
+// where anyone who can read the logs can take over the account; that
+// mailer is for local development only.
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	email := canonicalEmail(params.Email)
+	ip := clientIP(r)
+	if wait := cfg.passwordResetLimiter.Wait(email, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		respondWithError(w, http.StatusTooManyRequests, "Too many password resets requested; try again later")
+		return
+	}
+	cfg.passwordResetLimiter.Failed(email, ip)
+
+	user, err := cfg.DB.GetUserByEmail(email)
+	if err != nil && !errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	if err == nil {
+		// Mail in the background so response times don't tell
+		// existing accounts apart either.
+		go func() {
+			err := cfg.sendPasswordReset(user)
+			if err != nil {
+				log.Printf("Error sending password reset to user %d: %s", user.ID, err)
+			}
+		}()
+	}
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+func (cfg *apiConfig) sendPasswordReset(user database.User) error {
+	token, err := auth.NewTokenID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	err = cfg.DB.CreateUserToken(database.UserToken{
+		Hash:      auth.HashToken(token),
+		UserID:    user.ID,
+		Purpose:   database.TokenPurposePasswordReset,
+		CreatedAt: now,
+		ExpiresAt: now.Add(passwordResetTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Chirpy account.\n\n"+
+			"Your reset token is:\n\n    %s\n\n"+
+			"It can be used once within the next %d minutes. If you didn't ask for this, you can ignore this email.\n",
+			token, int(passwordResetTTL.Minutes())),
+	})
+}
+
+// handlerPasswordResetConfirm sets a new password using a reset token.
+// Every session and personal access token of the user is ended.
+func (cfg *apiConfig) handlerPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	// Check what can be checked before the single-use token is spent;
+	// the rule against using the email needs the user.
+	if !cfg.checkPasswordPolicy(w, params.Password, "") {
+		return
+	}
+
+	token, err := cfg.DB.ConsumeUserToken(auth.HashToken(params.Token), database.TokenPurposePasswordReset)
+	if errors.Is(err, database.ErrNotExist) || errors.Is(err, database.ErrTokenExpired) {
+		respondWithError(w, http.StatusBadRequest, "Reset token is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check reset token")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(token.UserID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusBadRequest, "Reset token is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+
+	hashedPassword, ok := cfg.checkPassword(w, params.Password, user.Email)
+	if !ok {
+		return
+	}
+
+	_, err = cfg.DB.UpdateUser(user.ID, user.Email, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password")
+		return
+	}
+
+	cfg.passwordResetLimiter.Succeeded(user.Email)
+
+	err = cfg.DB.RevokeUserRefreshTokens(user.ID, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't end sessions")
+		return
+	}
+	err = cfg.DB.DeleteUserPersonalAccessTokens(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke personal access tokens")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
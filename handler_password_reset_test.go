@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+)
+
+func TestPasswordResetRequestLimit(t *testing.T) {
+	cfg := newTestConfig(t)
+	request := func(email, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/password-reset/request", strings.NewReader(`{"email":"`+email+`"}`))
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		cfg.handlerPasswordResetRequest(rec, req)
+		return rec
+	}
+
+	// Unknown addresses are limited too, or the limit would give
+	// away which ones have accounts.
+	const email = "nobody@example.com"
+	// The free requests and the first throttled one go through.
+	for i := 0; i <= auth.MagicLinkAccountLimits.Free; i++ {
+		rec := request(email, "192.0.2.1")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("request %d: got status %d, want %d", i+1, rec.Code, http.StatusAccepted)
+		}
+	}
+	rec := request(" Nobody@Example.com", "192.0.2.2")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("same email from another IP: got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+
+	for i := 0; i <= auth.MagicLinkIPLimits.Free; i++ {
+		request(fmt.Sprintf("user%d@example.com", i), "192.0.2.3")
+	}
+	rec = request("another@example.com", "192.0.2.3")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("many emails from one IP: got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
@@ -1,55 +1,154 @@
 package main
 
 import (
+	"errors"
 	"net/http"
-	// "github.com/Bayan2019/chirpy/internal/auth"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
 )
 
-func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
+const (
+	accessTokenTTL  = time.Hour
+	refreshTokenTTL = 60 * 24 * time.Hour
+)
 
+// issueRefreshToken starts a new session for userID on the client
+// making request r. The session's ID is the family ID of its refresh
+// tokens.
+func (cfg *apiConfig) issueRefreshToken(r *http.Request, userID int) (token, sessionID string, err error) {
+	record, err := newRefreshTokenRecord()
+	if err != nil {
+		return "", "", err
+	}
+	record.UserID = userID
+
+	err = cfg.DB.CreateRefreshToken(record, database.Session{
+		UserAgent: clientUserAgent(r),
+		IP:        clientIP(r),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	token, err = auth.MakeRefreshJWT(userID, cfg.jwtKeys, refreshTokenTTL, record.ID)
+	if err != nil {
+		return "", "", err
+	}
+	return token, record.ID, nil
+}
+
+func newRefreshTokenRecord() (database.RefreshToken, error) {
+	tokenID, err := auth.NewTokenID()
+	if err != nil {
+		return database.RefreshToken{}, err
+	}
+
+	now := time.Now().UTC()
+	return database.RefreshToken{
+		ID:        tokenID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}, nil
+}
+
+// handlerRefresh exchanges a refresh token for a new access token and
+// a new refresh token. The old refresh token stops working; using it
+// again revokes the whole session.
+func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	type response struct {
-		Token string `json:"token"`
-	}
-
-	// 	refreshToken, err := auth.GetBearerToken(r.Header)
-	// 	if err != nil {
-	// 		respondWithError(w, http.StatusBadRequest, "Couldn't find JWT")
-	// 		return
-	// 	}
-
-	// 	isRevoked, err := cfg.DB.IsTokenRevoked(refreshToken)
-	// 	if err != nil {
-	// 		respondWithError(w, http.StatusInternalServerError, "Couldn't check session")
-	// 		return
-	// 	}
-	// 	if isRevoked {
-	// 		respondWithError(w, http.StatusUnauthorized, "Refresh token is revoked")
-	// 		return
-	// 	}
-
-	// 	accessToken, err := auth.RefreshToken(refreshToken, cfg.jwtSecret)
-	// 	if err != nil {
-	// 		respondWithError(w, http.StatusUnauthorized, "Couldn't validated JWT")
-	// 		return
-	// 	}
-
-	// 	respondWithJSON(w, http.StatusOK, response{
-	// 		Token: accessToken,
-	// 	})
-	// }
-
-	// func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
-	// 	refreshToken, err := auth.GetBearerToken(r.Header)
-	// 	if err != nil {
-	// 		respondWithError(w, http.StatusBadRequest, "Couldn't find JWT")
-	// 		return
-	// 	}
-
-	// 	err = cfg.DB.RevokeToken(refreshToken)
-	// 	if err != nil {
-	// 		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session")
-	// 		return
-	// 	}
-
-	// respondWithJSON(w, http.StatusOK, struct{}{})
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	refreshToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't find JWT")
+		return
+	}
+
+	claims, err := auth.ValidateJWT(refreshToken, cfg.jwtKeys, auth.TokenTypeRefresh)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT")
+		return
+	}
+	tokenID := claims.ID
+
+	next, err := newRefreshTokenRecord()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh JWT")
+		return
+	}
+
+	next, err = cfg.DB.RotateRefreshToken(tokenID, next, clientIP(r), clientUserAgent(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrTokenReused):
+			respondWithError(w, http.StatusUnauthorized, "Refresh token was already used; session revoked")
+		case errors.Is(err, database.ErrTokenRevoked):
+			respondWithError(w, http.StatusUnauthorized, "Refresh token is revoked")
+		case errors.Is(err, database.ErrTokenExpired), errors.Is(err, database.ErrNotExist):
+			respondWithError(w, http.StatusUnauthorized, "Refresh token is invalid")
+		default:
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check session")
+		}
+		return
+	}
+
+	// Deleted users can't refresh.
+	_, err = cfg.DB.GetUser(next.UserID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token is invalid")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+
+	newRefreshToken, err := auth.MakeRefreshJWT(next.UserID, cfg.jwtKeys, refreshTokenTTL, next.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh JWT")
+		return
+	}
+
+	accessToken, err := auth.MakeAccessJWT(next.UserID, next.FamilyID, cfg.jwtKeys, accessTokenTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Token:        accessToken,
+		RefreshToken: newRefreshToken,
+	})
+}
+
+// handlerRevoke ends the session the refresh token belongs to.
+func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
+	refreshToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't find JWT")
+		return
+	}
+
+	claims, err := auth.ValidateJWT(refreshToken, cfg.jwtKeys, auth.TokenTypeRefresh)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT")
+		return
+	}
+	tokenID := claims.ID
+
+	err = cfg.DB.RevokeRefreshToken(tokenID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token is invalid")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
 }
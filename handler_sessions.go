@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+// Session is a place the user is logged in, as shown to them.
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current marks the session the request came from.
+	Current bool `json:"current"`
+}
+
+func sessionResponse(session database.Session, currentID string) Session {
+	return Session{
+		ID:         session.ID,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		ExpiresAt:  session.ExpiresAt,
+		Current:    session.ID == currentID,
+	}
+}
+
+// currentSessionID returns the session the request's access token
+// belongs to, if any.
+func currentSessionID(r *http.Request) string {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		return ""
+	}
+	return claims.SessionID
+}
+
+// handlerSessionsList lists where the user is logged in, most recently
+// used first.
+func (cfg *apiConfig) handlerSessionsList(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	sessions, err := cfg.DB.GetUserSessions(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get sessions")
+		return
+	}
+
+	currentID := currentSessionID(r)
+	response := make([]Session, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, sessionResponse(session, currentID))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handlerSessionsRevoke logs the user out of one session. Its refresh
+// and access tokens stop working right away.
+func (cfg *apiConfig) handlerSessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	err := cfg.DB.RevokeSession(user.ID, chi.URLParam(r, "sessionID"))
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find session")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
+
+// handlerSessionsRevokeAll logs the user out everywhere, or with
+// ?keep_current=true everywhere but the session making the request.
+func (cfg *apiConfig) handlerSessionsRevokeAll(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	except := ""
+	if keepCurrent, _ := strconv.ParseBool(r.URL.Query().Get("keep_current")); keepCurrent {
+		except = currentSessionID(r)
+	}
+
+	err := cfg.DB.RevokeUserRefreshTokens(user.ID, except)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
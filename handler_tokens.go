@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	personalAccessTokenDefaultDays = 30
+	personalAccessTokenMaxDays     = 365
+	personalAccessTokenMaxName     = 100
+)
+
+// PersonalAccessToken is a personal access token as shown to its
+// owner. Token is only set in the response that creates it.
+type PersonalAccessToken struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Token     string    `json:"token,omitempty"`
+}
+
+func personalAccessTokenResponse(token database.PersonalAccessToken) PersonalAccessToken {
+	return PersonalAccessToken{
+		ID:        token.ID,
+		Name:      token.Name,
+		Scopes:    token.Scopes,
+		CreatedAt: token.CreatedAt,
+		ExpiresAt: token.ExpiresAt,
+	}
+}
+
+// handlerTokensList lists the user's personal access tokens.
+func (cfg *apiConfig) handlerTokensList(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	tokens, err := cfg.DB.GetPersonalAccessTokens(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get tokens")
+		return
+	}
+
+	response := make([]PersonalAccessToken, 0, len(tokens))
+	for _, token := range tokens {
+		response = append(response, personalAccessTokenResponse(token))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handlerTokensCreate creates a personal access token. The token is
+// only ever shown in this response.
+func (cfg *apiConfig) handlerTokensCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+
+	user, _ := auth.UserFromContext(r.Context())
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	name := strings.TrimSpace(params.Name)
+	if name == "" || len(name) > personalAccessTokenMaxName {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("name is required and at most %d characters", personalAccessTokenMaxName))
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "scopes must name at least one of "+strings.Join(auth.Scopes, ", "))
+		return
+	}
+	scopes := []string{}
+	for _, scope := range params.Scopes {
+		if !auth.ValidScope(scope) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown scope %q; scopes are %s", scope, strings.Join(auth.Scopes, ", ")))
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	days := params.ExpiresInDays
+	if days == 0 {
+		days = personalAccessTokenDefaultDays
+	}
+	if days < 0 || days > personalAccessTokenMaxDays {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("expires_in_days must be between 1 and %d", personalAccessTokenMaxDays))
+		return
+	}
+
+	token, err := auth.NewPersonalAccessToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create token")
+		return
+	}
+	now := time.Now().UTC()
+	record, err := cfg.DB.CreatePersonalAccessToken(database.PersonalAccessToken{
+		UserID:    user.ID,
+		Name:      name,
+		Hash:      auth.HashToken(token),
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, days),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save token")
+		return
+	}
+
+	response := personalAccessTokenResponse(record)
+	response.Token = token
+	respondWithJSON(w, http.StatusCreated, response)
+}
+
+// handlerTokensRevoke revokes one of the user's personal access tokens.
+func (cfg *apiConfig) handlerTokensRevoke(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	tokenID, err := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	err = cfg.DB.DeletePersonalAccessToken(user.ID, tokenID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke token")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
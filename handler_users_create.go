@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"time"
 
-	"github.com/Bayan2019/chirpy/internal/auth"
 	"github.com/Bayan2019/chirpy/internal/database"
 )
 
@@ -15,6 +15,9 @@ type User struct {
 	ID       int    `json:"id"`
 	Email    string `json:"email"`
 	Password string `json:"-"`
+	Role     string `json:"role"`
+	// VerifiedAt is when the user confirmed their email address.
+	VerifiedAt *time.Time `json:"verified_at"`
 	// IsChirpyRed bool   `json:"is_chirpy_red"`
 }
 
@@ -38,11 +41,17 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	email, err := normalizeEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	// 6. Authentication / 1. Authentication with Passwords
 	// Hash the password using the bcrypt.GenerateFromPassword function
-	hashedPassword, err := auth.HashPassword(params.Password)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
+	// once it passes the password policy.
+	hashedPassword, ok := cfg.checkPassword(w, params.Password, email)
+	if !ok {
 		return
 	}
 
@@ -52,7 +61,7 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 
 	// 6. Authentication / 1. Authentication with Passwords
 	// Be sure to store the hashed password in the database as you create the user.
-	user, err := cfg.DB.CreateUser(params.Email, hashedPassword)
+	user, err := cfg.DB.CreateUser(email, hashedPassword)
 	if err != nil {
 		if errors.Is(err, database.ErrAlreadyExists) {
 			respondWithError(w, http.StatusConflict, "User already exists")
@@ -63,10 +72,14 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	cfg.sendEmailVerificationAsync(user)
+
 	respondWithJSON(w, http.StatusCreated, response{
 		User: User{
-			ID:    user.ID,
-			Email: user.Email,
+			ID:         user.ID,
+			Email:      user.Email,
+			Role:       user.Role,
+			VerifiedAt: user.VerifiedAt,
 			// IsChirpyRed: user.IsChirpyRed,
 		},
 	})
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+// handlerUsersDelete deletes the user's account once they confirm
+// their password. Their chirps are deleted or kept anonymously
+// depending on DELETED_USER_CHIRPS.
+func (cfg *apiConfig) handlerUsersDelete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	user, _ := auth.UserFromContext(r.Context())
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "password is required to delete the account")
+		return
+	}
+	if !cfg.checkCurrentPassword(w, r, user, params.Password) {
+		return
+	}
+
+	err = cfg.DB.DeleteUser(user.ID, cfg.keepDeletedUserChirps)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusNotFound, "Couldn't find user")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete user")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, struct{}{})
+}
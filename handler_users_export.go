@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+// userExport is everything Chirpy keeps about a user, in the form
+// they get it from GET /api/users/export.
+type userExport struct {
+	ExportedAt time.Time     `json:"exported_at"`
+	Profile    exportProfile `json:"profile"`
+	Chirps     []Chirp       `json:"chirps"`
+	Sessions   []Session     `json:"sessions"`
+}
+
+type exportProfile struct {
+	User
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+}
+
+// handlerUsersExport sends the user a copy of their data: one JSON
+// document, or with ?format=zip an archive with profile.json,
+// chirps.json and sessions.json.
+func (cfg *apiConfig) handlerUsersExport(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "zip" {
+		respondWithError(w, http.StatusBadRequest, "format must be json or zip")
+		return
+	}
+
+	export, err := cfg.exportUser(user, currentSessionID(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't export user data")
+		return
+	}
+
+	filename := fmt.Sprintf("chirpy-export-%d-%s.%s", user.ID, export.ExportedAt.Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	if format == "json" {
+		respondWithJSON(w, http.StatusOK, export)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.WriteHeader(http.StatusOK)
+	err = writeExportZip(w, export)
+	if err != nil {
+		log.Printf("Error writing export of user %d: %s", user.ID, err)
+	}
+}
+
+func (cfg *apiConfig) exportUser(user database.User, currentSessionID string) (userExport, error) {
+	twoFactor := false
+	totp, err := cfg.DB.GetTOTP(user.ID)
+	if err == nil {
+		twoFactor = totp.Enabled()
+	} else if !errors.Is(err, database.ErrNotExist) {
+		return userExport{}, err
+	}
+
+	dbChirps, err := cfg.DB.GetChirps()
+	if err != nil {
+		return userExport{}, err
+	}
+	chirps := []Chirp{}
+	for _, chirp := range dbChirps {
+		if chirp.AuthorID != user.ID {
+			continue
+		}
+		chirps = append(chirps, Chirp{
+			ID:       chirp.ID,
+			AuthorID: chirp.AuthorID,
+			Body:     chirp.Body,
+		})
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].ID < chirps[j].ID
+	})
+
+	dbSessions, err := cfg.DB.GetUserSessions(user.ID)
+	if err != nil {
+		return userExport{}, err
+	}
+	sessions := make([]Session, 0, len(dbSessions))
+	for _, session := range dbSessions {
+		sessions = append(sessions, sessionResponse(session, currentSessionID))
+	}
+
+	return userExport{
+		ExportedAt: time.Now().UTC().Truncate(time.Second),
+		Profile: exportProfile{
+			User: User{
+				ID:         user.ID,
+				Email:      user.Email,
+				Role:       user.Role,
+				VerifiedAt: user.VerifiedAt,
+			},
+			TwoFactorEnabled: twoFactor,
+		},
+		Chirps:   chirps,
+		Sessions: sessions,
+	}, nil
+}
+
+func writeExportZip(w io.Writer, export userExport) error {
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"chirps.json", export.Chirps},
+		{"sessions.json", export.Sessions},
+	}
+	for _, file := range files {
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.content)
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
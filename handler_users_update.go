@@ -2,70 +2,138 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
 )
 
 // 6. Authentication / 6. Authentication with JWTs
+// PUT /api/users replaces both the email and the password;
+// PATCH /api/users changes only what is sent.
 func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request) {
 
 	type parameters struct {
-		Password string `json:"password"`
-		Email    string `json:"email"`
+		Password        string `json:"password"`
+		Email           string `json:"email"`
+		CurrentPassword string `json:"current_password"`
 	}
 
-	type response struct {
-		User
-	}
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
 
-	// 6. Authentication / 6. Authentication with JWTs
-	// This is our first authenticated endpoint,
-	// which means it will require a JWT to be present in the request headers
-	// First, extract the token from the request headers r.Header.Get
-	token, err := auth.GetBearerToken(r.Header)
+	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
 
-	// 6. Authentication / 6. Authentication with JWTs
-	subject, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	cfg.updateUser(w, r, userChanges{
+		Email:           &params.Email,
+		Password:        &params.Password,
+		CurrentPassword: params.CurrentPassword,
+	})
+}
+
+// handlerUsersPatch updates the fields of the user that are sent;
+// missing ones are left alone.
+func (cfg *apiConfig) handlerUsersPatch(w http.ResponseWriter, r *http.Request) {
+	params := userChanges{}
+	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT")
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
+	cfg.updateUser(w, r, params)
+}
 
-	err = decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
-		return
-	}
+// userChanges are the changes a user asks for; nil fields stay as they are.
+type userChanges struct {
+	Email    *string `json:"email"`
+	Password *string `json:"password"`
+	// CurrentPassword must be given to change the email or password,
+	// so a stolen access token can't be used to take over the account.
+	CurrentPassword string `json:"current_password"`
+}
 
-	hashedPassword, err := auth.HashPassword(params.Password)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
-		return
+func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request, changes userChanges) {
+	type response struct {
+		User
 	}
 
 	// 6. Authentication / 6. Authentication with JWTs
-	// If the JWT was valid, you should now have the ID of the authenticated user.
-	userIDInt, err := strconv.Atoi(subject)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't parse user ID")
-		return
+	// This is our first authenticated endpoint,
+	// which means it will require a JWT to be present in the request headers
+	// cfg.authn.Required now checks the token and loads the user.
+	currentUser, _ := auth.UserFromContext(r.Context())
+
+	email := currentUser.Email
+	if changes.Email != nil {
+		var err error
+		email, err = normalizeEmail(*changes.Email)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 	}
+	emailChanged := email != currentUser.Email
+	passwordChanged := changes.Password != nil
 
-	// 6. Authentication / 6. Authentication with JWTs
-	// You'll probably need to add a new UpdateUser method to your database package
-	user, err := cfg.DB.UpdateUser(userIDInt, params.Email, hashedPassword)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create user")
-		return
+	if emailChanged || passwordChanged {
+		if changes.CurrentPassword == "" {
+			respondWithError(w, http.StatusBadRequest, "current_password is required to change the email or password")
+			return
+		}
+		if !cfg.checkCurrentPassword(w, r, currentUser, changes.CurrentPassword) {
+			return
+		}
+	}
+
+	hashedPassword := currentUser.HashedPassword
+	if passwordChanged {
+		var ok bool
+		hashedPassword, ok = cfg.checkPassword(w, *changes.Password, email)
+		if !ok {
+			return
+		}
+	}
+
+	user := currentUser
+	if emailChanged || passwordChanged {
+		// 6. Authentication / 6. Authentication with JWTs
+		// You'll probably need to add a new UpdateUser method to your database package
+		var err error
+		user, err = cfg.DB.UpdateUser(currentUser.ID, email, hashedPassword)
+		if errors.Is(err, database.ErrAlreadyExists) {
+			respondWithError(w, http.StatusConflict, "Email is already in use")
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update user")
+			return
+		}
+	}
+	if emailChanged {
+		cfg.sendEmailVerificationAsync(user)
+	}
+
+	// Whoever may have learned the old password is logged out, and
+	// loses any personal access tokens they minted with it; the
+	// session making the change stays logged in.
+	if passwordChanged {
+		err := cfg.DB.RevokeUserRefreshTokens(user.ID, currentSessionID(r))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't end other sessions")
+			return
+		}
+		err = cfg.DB.DeleteUserPersonalAccessTokens(user.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't revoke personal access tokens")
+			return
+		}
 	}
 
 	// 6. Authentication / 6. Authentication with JWTs
@@ -74,8 +142,29 @@ func (cfg *apiConfig) handlerUsersUpdate(w http.ResponseWriter, r *http.Request)
 	// (without the password) and a 200 status code
 	respondWithJSON(w, http.StatusOK, response{
 		User: User{
-			ID:    user.ID,
-			Email: user.Email,
+			ID:         user.ID,
+			Email:      user.Email,
+			Role:       user.Role,
+			VerifiedAt: user.VerifiedAt,
 		},
 	})
 }
+
+// checkCurrentPassword makes the user prove they know their password
+// before a sensitive change. Wrong guesses count as failed logins.
+func (cfg *apiConfig) checkCurrentPassword(w http.ResponseWriter, r *http.Request, user database.User, password string) bool {
+	ip := clientIP(r)
+	if wait := cfg.loginLimiter.Wait(user.Email, ip); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		respondWithError(w, http.StatusTooManyRequests, "Too many failed attempts; try again later")
+		return false
+	}
+
+	err := auth.CheckPasswordHash(password, user.HashedPassword)
+	if err != nil {
+		cfg.loginLimiter.Failed(user.Email, ip)
+		respondWithError(w, http.StatusForbidden, "Password is incorrect")
+		return false
+	}
+	return true
+}
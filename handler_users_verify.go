@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+	"github.com/Bayan2019/chirpy/internal/mailer"
+)
+
+const emailVerificationTTL = 48 * time.Hour
+
+// sendEmailVerification mails user a link that proves they own
+// their current email address.
+func (cfg *apiConfig) sendEmailVerification(user database.User) error {
+	token, err := auth.NewTokenID()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	err = cfg.DB.CreateUserToken(database.UserToken{
+		Hash:      auth.HashToken(token),
+		UserID:    user.ID,
+		Purpose:   database.TokenPurposeEmailVerification,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(emailVerificationTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/api/users/verify?token=%s", cfg.publicURL, url.QueryEscape(token))
+	return cfg.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body: fmt.Sprintf("Open this link to confirm this is your email address:\n\n    %s\n\n"+
+			"The link works once within the next %d hours. If you didn't sign up for Chirpy, you can ignore this email.\n",
+			link, int(emailVerificationTTL.Hours())),
+	})
+}
+
+// sendEmailVerificationAsync mails the verification link without
+// holding up the response.
+func (cfg *apiConfig) sendEmailVerificationAsync(user database.User) {
+	go func() {
+		err := cfg.sendEmailVerification(user)
+		if err != nil {
+			log.Printf("Error sending email verification to user %d: %s", user.ID, err)
+		}
+	}()
+}
+
+// handlerUsersVerify confirms an email address with the token from
+// the verification link.
+func (cfg *apiConfig) handlerUsersVerify(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing verification token")
+		return
+	}
+
+	userToken, err := cfg.DB.ConsumeUserToken(auth.HashToken(token), database.TokenPurposeEmailVerification)
+	if errors.Is(err, database.ErrNotExist) || errors.Is(err, database.ErrTokenExpired) {
+		respondWithError(w, http.StatusBadRequest, "Verification link is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check verification token")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userToken.UserID)
+	if errors.Is(err, database.ErrNotExist) {
+		respondWithError(w, http.StatusBadRequest, "Verification link is invalid or expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user")
+		return
+	}
+	// The user changed their email after the link was sent.
+	if user.Email != userToken.Email {
+		respondWithError(w, http.StatusBadRequest, "Verification link is invalid or expired")
+		return
+	}
+
+	user, err = cfg.DB.VerifyUser(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify user")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, User{
+		ID:         user.ID,
+		Email:      user.Email,
+		Role:       user.Role,
+		VerifiedAt: user.VerifiedAt,
+	})
+}
+
+// handlerUsersVerifyResend mails a new verification link to the
+// authenticated user.
+func (cfg *apiConfig) handlerUsersVerifyResend(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserFromContext(r.Context())
+	if user.VerifiedAt != nil {
+		respondWithError(w, http.StatusConflict, "Email address is already verified")
+		return
+	}
+
+	err := cfg.sendEmailVerification(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email")
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
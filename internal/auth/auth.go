@@ -1,15 +1,19 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var ErrNoAuthHeaderIncluded = errors.New("not auth header included in request")
@@ -19,123 +23,203 @@ type TokenType string
 const (
 	TokenTypeAccess  TokenType = "chirpy-access"
 	TokenTypeRefresh TokenType = "chirpy-refresh"
+	// TokenTypeMFA is issued after a correct password when the account
+	// has two-factor authentication; it is exchanged, together with
+	// a second factor, for the real tokens.
+	TokenTypeMFA TokenType = "chirpy-mfa"
 )
 
 // 6. Authentication / 1. Authentication with Passwords
 // Hash the password using the bcrypt.GenerateFromPassword function
-// HashPassword -
+// HashPassword hashes with the algorithm and parameters set by
+// SetPasswordParams (argon2id by default).
 func HashPassword(password string) (string, error) {
-	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
-	}
-
-	return string(dat), nil
+	return hashPassword(password, passwordParams)
 }
 
 // 6. Authentication / 1. Authentication with Passwords
 // Use the bcrypt.CompareHashAndPassword function
 // to compare the password that the user entered in the HTTP request
 // with the password that is stored in the database.
-// CheckPasswordHash -
+// CheckPasswordHash accepts argon2id and bcrypt hashes alike;
+// see PasswordNeedsRehash for upgrading old ones.
 func CheckPasswordHash(password, hash string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return checkPasswordHash(password, hash)
+}
+
+// dummyHash is a hash of a random password, checked against when a
+// login names an unknown user so the response takes just as long.
+var dummyHash = sync.OnceValue(func() string {
+	password, err := NewTokenID()
+	if err == nil {
+		var hash string
+		hash, err = HashPassword(password)
+		if err == nil {
+			return hash
+		}
+	}
+	panic("auth: can't create dummy password hash: " + err.Error())
+})
+
+// CheckDummyPasswordHash does the work of CheckPasswordHash without a
+// real hash to check, so unknown users can't be told apart by timing.
+func CheckDummyPasswordHash(password string) {
+	CheckPasswordHash(password, dummyHash())
+}
+
+// Issuer is the iss claim of every token Chirpy issues.
+const Issuer = "chirpy"
+
+// audiences maps each token type to the aud claim it is issued for,
+// so a token minted for one purpose is rejected everywhere else.
+var audiences = map[TokenType]string{
+	TokenTypeAccess:  "chirpy-api",
+	TokenTypeRefresh: "chirpy-refresh",
+	TokenTypeMFA:     "chirpy-mfa",
+}
+
+var ErrWrongTokenType = errors.New("wrong token type")
+
+// Claims are the claims of a Chirpy token.
+type Claims struct {
+	jwt.RegisteredClaims
+	TokenType TokenType `json:"token_type"`
+	// SessionID is the refresh token family an access token was
+	// issued for, so a request can tell which session it is from.
+	SessionID string `json:"sid,omitempty"`
+	// ClientID is set on access tokens issued to an OAuth client,
+	// which may only do what Scope allows.
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+}
+
+// HasScope reports whether an OAuth access token was granted scope.
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+// UserID returns the user the token was issued to.
+func (c *Claims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
 }
 
 // 6. Authentication / 6. Authentication with JWTs
 // Create a JWT using JWT library
-func MakeJWT(userID int, tokenSecret string, expiresIn time.Duration, tokenType TokenType) (string, error) {
-	signingKey := []byte(tokenSecret)
+func MakeJWT(userID int, keys *KeyRing, expiresIn time.Duration, tokenType TokenType) (string, error) {
+	return makeToken(userID, keys, expiresIn, Claims{
+		TokenType: tokenType,
+	})
+}
 
-	// 6. Authentication / 6. Authentication with JWTs
-	// Use jwt.NewWithClaims to create a new token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		// 6. Authentication / 6. Authentication with JWTs
-		// Set the Issuer to "chirpy"
-		Issuer: "chirpy",
-		//Issuer:    string(tokenType),
-		// 6. Authentication / 6. Authentication with JWTs
-		// Set IssuedAt to the current time in UTC
-		IssuedAt: jwt.NewNumericDate(time.Now().UTC()),
-		// 6. Authentication / 6. Authentication with JWTs
-		// Set ExpiresAt to the current time plus the expiration time
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		// 6. Authentication / 6. Authentication with JWTs
-		// Set the Subject to a stringified version of the user's id
-		Subject: fmt.Sprintf("%d", userID),
+// MakeAccessJWT creates an access token for the session sessionID.
+func MakeAccessJWT(userID int, sessionID string, keys *KeyRing, expiresIn time.Duration) (string, error) {
+	return makeToken(userID, keys, expiresIn, Claims{
+		TokenType: TokenTypeAccess,
+		SessionID: sessionID,
 	})
+}
 
-	// 6. Authentication / 6. Authentication with JWTs
-	// Use token.SignedString to sign the token with the secret key.
-	return token.SignedString(signingKey)
+// MakeOAuthAccessJWT creates an access token for the OAuth client
+// clientID, limited to scopes.
+func MakeOAuthAccessJWT(userID int, clientID string, scopes []string, keys *KeyRing, expiresIn time.Duration) (string, error) {
+	return makeToken(userID, keys, expiresIn, Claims{
+		TokenType: TokenTypeAccess,
+		ClientID:  clientID,
+		Scope:     strings.Join(scopes, " "),
+	})
 }
 
-func RefreshToken(tokenString, tokenSecret string) (string, error) {
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, &claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
-	)
-	if err != nil {
-		return "", err
-	}
+// MakeRefreshJWT creates a refresh token whose ID (jti) is tokenID,
+// the key of its server-side record.
+func MakeRefreshJWT(userID int, keys *KeyRing, expiresIn time.Duration, tokenID string) (string, error) {
+	return makeToken(userID, keys, expiresIn, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{ID: tokenID},
+		TokenType:        TokenTypeRefresh,
+	})
+}
 
-	userIDString, err := token.Claims.GetSubject()
-	if err != nil {
-		return "", err
+// makeToken fills in the registered claims of claims and signs it.
+func makeToken(userID int, keys *KeyRing, expiresIn time.Duration, claims Claims) (string, error) {
+	audience, ok := audiences[claims.TokenType]
+	if !ok {
+		return "", fmt.Errorf("unknown token type %q", claims.TokenType)
 	}
 
-	issuer, err := token.Claims.GetIssuer()
-	if err != nil {
-		return "", err
-	}
-	if issuer != string(TokenTypeRefresh) {
-		return "", errors.New("invalid issuer")
-	}
+	// 6. Authentication / 6. Authentication with JWTs
+	// Set the Issuer to "chirpy"
+	claims.Issuer = Issuer
+	claims.Audience = jwt.ClaimStrings{audience}
+	// 6. Authentication / 6. Authentication with JWTs
+	// Set IssuedAt to the current time in UTC
+	claims.IssuedAt = jwt.NewNumericDate(time.Now().UTC())
+	// 6. Authentication / 6. Authentication with JWTs
+	// Set ExpiresAt to the current time plus the expiration time
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().UTC().Add(expiresIn))
+	// 6. Authentication / 6. Authentication with JWTs
+	// Set the Subject to a stringified version of the user's id
+	claims.Subject = subject(userID)
 
-	userID, err := strconv.Atoi(userIDString)
-	if err != nil {
-		return "", err
-	}
+	// 6. Authentication / 6. Authentication with JWTs
+	// Use jwt.NewWithClaims to create a new token
+	return keys.sign(claims)
+}
 
-	newToken, err := MakeJWT(userID, tokenSecret, time.Hour, TokenTypeAccess)
+// subject returns the sub claim for user userID.
+func subject(userID int) string {
+	return fmt.Sprintf("%d", userID)
+}
+
+// NewTokenID returns a random identifier for a server-side token record.
+func NewTokenID() (string, error) {
+	dat := make([]byte, 32)
+	_, err := rand.Read(dat)
 	if err != nil {
 		return "", err
 	}
+	return hex.EncodeToString(dat), nil
+}
 
-	return newToken, nil
+// HashToken returns the SHA-256 hash (hex) under which a random token
+// is stored. Tokens are long and random, so a fast hash is enough.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 // 6. Authentication / 6. Authentication with JWTs
-func ValidateJWT(tokenString, tokenSecret string) (string, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+// ValidateJWT checks the signature, expiry, issuer and audience of a
+// token and that it was issued as tokenType, and returns its claims.
+// The signature must come from a key in keys that isn't retired,
+// using that key's algorithm.
+func ValidateJWT(tokenString string, keys *KeyRing, tokenType TokenType) (*Claims, error) {
+	audience, ok := audiences[tokenType]
+	if !ok {
+		return nil, fmt.Errorf("unknown token type %q", tokenType)
+	}
+
+	claims := &Claims{}
 	// 6. Authentication / 6. Authentication with JWTs
 	// use the jwt.ParseWithClaims function to validate the signature of the JWT
 	// and extract the claims into a *jwt.Token struct
-	token, err := jwt.ParseWithClaims(tokenString, &claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+	_, err := jwt.ParseWithClaims(tokenString, claims,
+		keys.keyfunc,
+		jwt.WithValidMethods(keys.validMethods()),
+		jwt.WithIssuer(Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
 	)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// 6. Authentication / 6. Authentication with JWTs
-	// use the token.Claims interface
-	// to get access to the user's id from the claims
-	// (which should be stored in the Subject field)
-	userIDString, err := token.Claims.GetSubject()
-	if err != nil {
-		return "", err
+	if claims.TokenType != tokenType {
+		return nil, ErrWrongTokenType
+	}
+	if tokenType == TokenTypeRefresh && claims.ID == "" {
+		return nil, errors.New("refresh token has no ID")
 	}
 
-	// issuer, err := token.Claims.GetIssuer()
-	// if err != nil {
-	// 	return "", err
-	// }
-	// if issuer != string(TokenTypeAccess) {
-	// 	return "", errors.New("invalid issuer")
-	// }
-
-	return userIDString, nil
+	return claims, nil
 }
 
 // 6. Authentication / 6. Authentication with JWTs
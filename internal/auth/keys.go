@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// LegacyKeyID is the kid of the HS256 key made from JWT_SECRET.
+// Tokens without a kid header were signed with it.
+const LegacyKeyID = "hs256"
+
+// Key is one JWT signing key.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// Retired keys no longer sign or verify anything.
+	Retired bool
+
+	signKey   any
+	verifyKey any
+}
+
+// NewHMACKey makes an HS256 key from a shared secret.
+func NewHMACKey(id string, secret []byte) *Key {
+	return &Key{
+		ID:        id,
+		Method:    jwt.SigningMethodHS256,
+		signKey:   secret,
+		verifyKey: secret,
+	}
+}
+
+// ParsePrivateKeyPEM reads an RSA (RS256) or Ed25519 (EdDSA)
+// private key in PEM form.
+func ParsePrivateKeyPEM(id string, dat []byte) (*Key, error) {
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, fmt.Errorf("key %s: no PEM data", id)
+	}
+
+	var private any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("key %s: unsupported PEM block %q", id, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", id, err)
+	}
+
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("key %s: RSA keys must be at least 2048 bits", id)
+		}
+		return &Key{ID: id, Method: jwt.SigningMethodRS256, signKey: k, verifyKey: &k.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: id, Method: jwt.SigningMethodEdDSA, signKey: k, verifyKey: k.Public()}, nil
+	default:
+		return nil, fmt.Errorf("key %s: unsupported key type %T", id, private)
+	}
+}
+
+// GeneratePrivateKeyPEM creates a new "ed25519" or "rsa" private key
+// in PKCS #8 PEM form.
+func GeneratePrivateKeyPEM(keyType string) ([]byte, error) {
+	var private any
+	var err error
+	switch keyType {
+	case "ed25519":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case "rsa":
+		private, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// KeyRing holds every key tokens may be signed with. New tokens are
+// signed with the active key and carry its ID in the kid header;
+// tokens are accepted when signed by any key that isn't retired.
+// Rotating means adding a key, making it active, and retiring the
+// old key once the tokens it signed have expired.
+type KeyRing struct {
+	keys   map[string]*Key
+	active *Key
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: map[string]*Key{}}
+}
+
+// Add adds key to the ring. The first key added becomes active.
+func (kr *KeyRing) Add(key *Key) error {
+	if _, ok := kr.keys[key.ID]; ok {
+		return fmt.Errorf("duplicate key %s", key.ID)
+	}
+	kr.keys[key.ID] = key
+	if kr.active == nil && !key.Retired {
+		kr.active = key
+	}
+	return nil
+}
+
+// SetActive makes the key id the one new tokens are signed with.
+func (kr *KeyRing) SetActive(id string) error {
+	key, ok := kr.keys[id]
+	if !ok {
+		return fmt.Errorf("no key %s", id)
+	}
+	if key.Retired {
+		return fmt.Errorf("key %s is retired", id)
+	}
+	kr.active = key
+	return nil
+}
+
+// Retire stops the key id from signing or verifying tokens.
+func (kr *KeyRing) Retire(id string) error {
+	key, ok := kr.keys[id]
+	if !ok {
+		return fmt.Errorf("no key %s", id)
+	}
+	if kr.active == key {
+		return fmt.Errorf("key %s is active", id)
+	}
+	key.Retired = true
+	return nil
+}
+
+// LoadKeyRing builds the ring from the environment's settings: every
+// *.pem file in dir is a key named after the file, secret (if set) adds
+// the legacy HS256 key, active names the signing key and retired lists
+// keys to reject. dir may be empty to use only the secret.
+func LoadKeyRing(dir, secret, active string, retired []string) (*KeyRing, error) {
+	kr := NewKeyRing()
+
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			dat, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			key, err := ParsePrivateKeyPEM(strings.TrimSuffix(filepath.Base(path), ".pem"), dat)
+			if err != nil {
+				return nil, err
+			}
+			err = kr.Add(key)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if secret != "" {
+		err := kr.Add(NewHMACKey(LegacyKeyID, []byte(secret)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(kr.keys) == 0 {
+		return nil, errors.New("no JWT signing keys configured")
+	}
+
+	if active != "" {
+		err := kr.SetActive(active)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(kr.keys) > 1 {
+		return nil, errors.New("several JWT signing keys configured but no active key chosen")
+	}
+
+	for _, id := range retired {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		err := kr.Retire(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// sign signs claims with the active key.
+func (kr *KeyRing) sign(claims jwt.Claims) (string, error) {
+	if kr.active == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(kr.active.Method, claims)
+	token.Header["kid"] = kr.active.ID
+	return token.SignedString(kr.active.signKey)
+}
+
+// keyfunc picks the verification key named by the token's kid header,
+// and only accepts the algorithm that key is meant for.
+func (kr *KeyRing) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = LegacyKeyID
+	}
+
+	key, ok := kr.keys[kid]
+	if !ok || key.Retired {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), kid)
+	}
+	return key.verifyKey, nil
+}
+
+// validMethods lists the algorithms of the keys in the ring.
+func (kr *KeyRing) validMethods() []string {
+	methods := []string{}
+	seen := map[string]bool{}
+	for _, key := range kr.keys {
+		alg := key.Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+// JWK is a public key in JSON Web Key form (RFC 7517).
+type JWK struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Alg     string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKSet is the body of the JWKS endpoint.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of every key that isn't retired.
+// Shared HMAC secrets are never published.
+func (kr *KeyRing) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range kr.keys {
+		if key.Retired {
+			continue
+		}
+
+		jwk := JWK{
+			KeyID: key.ID,
+			Use:   "sig",
+			Alg:   key.Method.Alg(),
+		}
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].KeyID < set.Keys[j].KeyID
+	})
+	return set
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "legacy secret"
+
+// writeTestKey writes a new private key of keyType to dir/id.pem.
+// RSA keys are 2048 bits, the smallest accepted, to keep tests fast.
+func writeTestKey(t *testing.T, dir, id, keyType string) []byte {
+	t.Helper()
+	var dat []byte
+	if keyType == "rsa" {
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dat = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	} else {
+		var err error
+		dat, err = GeneratePrivateKeyPEM(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(dir, id+".pem"), dat, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dat
+}
+
+// signTestToken signs a valid access token for user 1 with method
+// and signKey, with kid as its kid header unless kid is empty.
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, signKey any) string {
+	t.Helper()
+	now := time.Now().UTC()
+	token := jwt.NewWithClaims(method, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{audiences[TokenTypeAccess]},
+			Subject:   subject(1),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+		TokenType: TokenTypeAccess,
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	tokenString, err := token.SignedString(signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenString
+}
+
+func TestValidateJWTRejectsMismatchedAlgorithm(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "rsa1", "rsa")
+	keys, err := LoadKeyRing(dir, testSecret, "rsa1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(keys.keys["rsa1"].verifyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})
+
+	tests := []struct {
+		name    string
+		signKey []byte
+	}{
+		// The classic confusion attack: HMAC keyed with the public key.
+		{name: "public key as HMAC secret", signKey: publicPEM},
+		// HS256 is a valid method in this ring, just not for rsa1.
+		{name: "legacy secret", signKey: []byte(testSecret)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := signTestToken(t, jwt.SigningMethodHS256, "rsa1", tt.signKey)
+			_, err := ValidateJWT(token, keys, TokenTypeAccess)
+			if err == nil {
+				t.Fatal("HS256 token with an RS256 kid was accepted")
+			}
+		})
+	}
+
+	token, err := MakeJWT(1, keys, time.Hour, TokenTypeAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateJWT(token, keys, TokenTypeAccess)
+	if err != nil {
+		t.Fatalf("token signed by rsa1 rejected: %v", err)
+	}
+}
+
+func TestValidateJWTRejectsRetiredKey(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "old", "ed25519")
+	writeTestKey(t, dir, "new", "ed25519")
+
+	keys, err := LoadKeyRing(dir, "", "old", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := MakeJWT(1, keys, time.Hour, TokenTypeAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotated but not yet retired: old tokens still verify.
+	keys, err = LoadKeyRing(dir, "", "new", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateJWT(token, keys, TokenTypeAccess)
+	if err != nil {
+		t.Fatalf("token from a rotated key rejected: %v", err)
+	}
+
+	keys, err = LoadKeyRing(dir, "", "new", []string{"old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateJWT(token, keys, TokenTypeAccess)
+	if err == nil {
+		t.Fatal("token from a retired key was accepted")
+	}
+}
+
+func TestValidateJWTWithoutKeyID(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "ed1", "ed25519")
+	token := signTestToken(t, jwt.SigningMethodHS256, "", []byte(testSecret))
+
+	tests := []struct {
+		name    string
+		secret  string
+		wantErr bool
+	}{
+		{name: "JWT_SECRET set", secret: testSecret, wantErr: false},
+		{name: "JWT_SECRET unset", secret: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := LoadKeyRing(dir, tt.secret, "ed1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ValidateJWT(token, keys, TokenTypeAccess)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateJWT error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Without a kid only the legacy key is tried, never the others.
+	keys, err := LoadKeyRing(dir, testSecret, "ed1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ParsePrivateKeyPEM("ed1", writeTestKey(t, t.TempDir(), "ed1", "ed25519"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token = signTestToken(t, jwt.SigningMethodEdDSA, "", private.signKey)
+	_, err = ValidateJWT(token, keys, TokenTypeAccess)
+	if err == nil {
+		t.Fatal("EdDSA token without kid was accepted")
+	}
+}
+
+func TestLoadKeyRingNeedsActiveKey(t *testing.T) {
+	twoKeys := t.TempDir()
+	writeTestKey(t, twoKeys, "a", "ed25519")
+	writeTestKey(t, twoKeys, "b", "ed25519")
+	oneKey := t.TempDir()
+	writeTestKey(t, oneKey, "a", "ed25519")
+
+	tests := []struct {
+		name    string
+		dir     string
+		secret  string
+		active  string
+		wantErr bool
+	}{
+		{name: "two keys, no active", dir: twoKeys, wantErr: true},
+		{name: "key and secret, no active", dir: oneKey, secret: testSecret, wantErr: true},
+		{name: "two keys, active", dir: twoKeys, active: "b"},
+		{name: "key and secret, legacy active", dir: oneKey, secret: testSecret, active: LegacyKeyID},
+		{name: "one key", dir: oneKey},
+		{name: "secret only", secret: testSecret},
+		{name: "no keys", dir: t.TempDir(), wantErr: true},
+		{name: "unknown active", dir: oneKey, active: "c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadKeyRing(tt.dir, tt.secret, tt.active, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadKeyRing error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWKSOmitsHMACKey(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "ed1", "ed25519")
+	writeTestKey(t, dir, "rsa1", "rsa")
+	keys, err := LoadKeyRing(dir, testSecret, LegacyKeyID, []string{"rsa1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := keys.JWKS()
+	if len(set.Keys) != 1 {
+		t.Fatalf("JWKS has %d keys, want 1: %+v", len(set.Keys), set.Keys)
+	}
+	jwk := set.Keys[0]
+	if jwk.KeyID != "ed1" || jwk.KeyType != "OKP" || jwk.Alg != "EdDSA" || jwk.X == "" {
+		t.Errorf("JWKS key = %+v, want the public half of ed1", jwk)
+	}
+
+	keys, err = LoadKeyRing("", testSecret, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set := keys.JWKS(); len(set.Keys) != 0 {
+		t.Errorf("JWKS of an HMAC-only ring = %+v, want no keys", set.Keys)
+	}
+}
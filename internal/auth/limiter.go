@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// LoginLimits configures how failed logins for one key (an account or
+// an IP address) are throttled. After Free failures every further one
+// makes the key wait BaseDelay, doubling per failure up to MaxDelay;
+// after LockoutAfter failures the key is locked for Lockout. Failures
+// are forgotten once none happened for ForgetAfter.
+type LoginLimits struct {
+	Free         int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int
+	Lockout      time.Duration
+	ForgetAfter  time.Duration
+}
+
+var (
+	DefaultAccountLimits = LoginLimits{
+		Free:         3,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: 10,
+		Lockout:      15 * time.Minute,
+		ForgetAfter:  24 * time.Hour,
+	}
+	DefaultIPLimits = LoginLimits{
+		Free:         20,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: 100,
+		Lockout:      time.Hour,
+		ForgetAfter:  24 * time.Hour,
+	}
+
+	// Mailed links (magic login links and password resets) are
+	// throttled by counting every request as a failure, so nobody can
+	// flood a mailbox with them.
+	MagicLinkAccountLimits = LoginLimits{
+		Free:         3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     15 * time.Minute,
+		LockoutAfter: 10,
+		Lockout:      time.Hour,
+		ForgetAfter:  time.Hour,
+	}
+	MagicLinkIPLimits = LoginLimits{
+		Free:         10,
+		BaseDelay:    time.Minute,
+		MaxDelay:     15 * time.Minute,
+		LockoutAfter: 50,
+		Lockout:      time.Hour,
+		ForgetAfter:  time.Hour,
+	}
+)
+
+// LoginLimiter counts failed logins per account and per client IP.
+// The counts live in memory, so they reset when the server restarts,
+// and at most maxLimiterEntries of each are kept.
+type LoginLimiter struct {
+	mu       sync.Mutex
+	accounts *failureCounter
+	ips      *failureCounter
+	now      func() time.Time
+}
+
+func NewLoginLimiter(accountLimits, ipLimits LoginLimits) *LoginLimiter {
+	return &LoginLimiter{
+		accounts: newFailureCounter(accountLimits),
+		ips:      newFailureCounter(ipLimits),
+		now:      time.Now,
+	}
+}
+
+// Wait returns how long a login for account from ip must wait;
+// zero means it may go ahead.
+func (l *LoginLimiter) Wait(account, ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	return max(l.accounts.wait(account, now), l.ips.wait(ip, now))
+}
+
+// Failed records a failed login. Unknown accounts are counted too,
+// so throttling doesn't reveal which accounts exist.
+func (l *LoginLimiter) Failed(account, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.accounts.fail(account, now)
+	l.ips.fail(ip, now)
+}
+
+// Succeeded clears the failures of account. The IP keeps its count,
+// so an attacker can't reset it by logging into their own account.
+func (l *LoginLimiter) Succeeded(account string) {
+	l.Unlock(account)
+}
+
+// Unlock clears the failures and any lockout of account.
+func (l *LoginLimiter) Unlock(account string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.accounts.entries, account)
+}
+
+// UnlockIP clears the failures and any lockout of the client address ip.
+func (l *LoginLimiter) UnlockIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.ips.entries, ip)
+}
+
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// maxLimiterEntries caps how many accounts or IPs a failureCounter
+// tracks, since anyone can make it count made-up email addresses.
+const maxLimiterEntries = 100_000
+
+// limiterPruneInterval is how often forgotten entries are dropped.
+const limiterPruneInterval = time.Minute
+
+type failureCounter struct {
+	limits     LoginLimits
+	entries    map[string]*failures
+	maxEntries int
+	lastPrune  time.Time
+}
+
+func newFailureCounter(limits LoginLimits) *failureCounter {
+	return &failureCounter{
+		limits:     limits,
+		entries:    map[string]*failures{},
+		maxEntries: maxLimiterEntries,
+	}
+}
+
+func (c *failureCounter) wait(key string, now time.Time) time.Duration {
+	f, ok := c.entries[key]
+	if !ok || !now.Before(f.until) {
+		return 0
+	}
+	return f.until.Sub(now)
+}
+
+func (c *failureCounter) fail(key string, now time.Time) {
+	c.prune(now)
+
+	f, ok := c.entries[key]
+	if !ok {
+		if len(c.entries) >= c.maxEntries {
+			c.evict(now)
+		}
+		f = &failures{}
+		c.entries[key] = f
+	}
+	if now.Sub(f.last) >= c.limits.ForgetAfter {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+
+	switch {
+	case f.count >= c.limits.LockoutAfter:
+		f.until = now.Add(c.limits.Lockout)
+	case f.count > c.limits.Free:
+		f.until = now.Add(c.delay(f.count - c.limits.Free))
+	}
+}
+
+// delay is the backoff after the nth failure past the free ones.
+func (c *failureCounter) delay(n int) time.Duration {
+	d := c.limits.BaseDelay
+	for i := 1; i < n && d < c.limits.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, c.limits.MaxDelay)
+}
+
+// prune drops forgotten entries, at most once per limiterPruneInterval.
+func (c *failureCounter) prune(now time.Time) {
+	if now.Sub(c.lastPrune) < limiterPruneInterval {
+		return
+	}
+	c.lastPrune = now
+
+	for key, f := range c.entries {
+		if c.forgotten(f, now) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// evict makes room in a full counter. Forgotten entries go first, then
+// the least recently failed of those not currently made to wait, down
+// to 90% of the cap so it doesn't run on every failure. Keys that are
+// waiting out a delay or lockout are never evicted.
+func (c *failureCounter) evict(now time.Time) {
+	c.lastPrune = now
+	idle := make([]string, 0, len(c.entries))
+	for key, f := range c.entries {
+		switch {
+		case c.forgotten(f, now):
+			delete(c.entries, key)
+		case !now.Before(f.until):
+			idle = append(idle, key)
+		}
+	}
+
+	excess := len(c.entries) - c.maxEntries*9/10
+	if excess <= 0 {
+		return
+	}
+	slices.SortFunc(idle, func(a, b string) int {
+		return c.entries[a].last.Compare(c.entries[b].last)
+	})
+	for _, key := range idle[:min(excess, len(idle))] {
+		delete(c.entries, key)
+	}
+}
+
+func (c *failureCounter) forgotten(f *failures, now time.Time) bool {
+	return now.Sub(f.last) >= c.limits.ForgetAfter && !now.Before(f.until)
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(now *time.Time) *LoginLimiter {
+	l := NewLoginLimiter(DefaultAccountLimits, DefaultIPLimits)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestLoginLimiterPrunesForgottenEntries(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestLimiter(&now)
+
+	for i := 0; i < 100; i++ {
+		l.Failed(fmt.Sprintf("user%d@example.com", i), "192.0.2.1")
+	}
+	now = now.Add(DefaultAccountLimits.ForgetAfter)
+	l.Failed("late@example.com", "192.0.2.2")
+
+	if n := len(l.accounts.entries); n != 1 {
+		t.Errorf("%d accounts tracked after the others were forgotten, want 1", n)
+	}
+	if n := len(l.ips.entries); n != 1 {
+		t.Errorf("%d IPs tracked after the others were forgotten, want 1", n)
+	}
+}
+
+func TestLoginLimiterCapsEntries(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestLimiter(&now)
+	l.accounts.maxEntries = 10
+
+	// A locked out account survives eviction.
+	for i := 0; i < DefaultAccountLimits.LockoutAfter; i++ {
+		l.Failed("victim@example.com", "192.0.2.1")
+	}
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Second)
+		l.Failed(fmt.Sprintf("user%d@example.com", i), "192.0.2.1")
+	}
+
+	if n := len(l.accounts.entries); n > 10 {
+		t.Errorf("%d accounts tracked, want at most 10", n)
+	}
+	if wait := l.Wait("victim@example.com", "192.0.2.3"); wait == 0 {
+		t.Error("locked out account was evicted")
+	}
+	if _, ok := l.accounts.entries["user99@example.com"]; !ok {
+		t.Error("the most recent failure was evicted")
+	}
+}
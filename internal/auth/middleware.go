@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+// UserStore loads the user a token was issued to.
+type UserStore interface {
+	GetUser(id int) (database.User, error)
+}
+
+// TokenStore looks up personal access tokens.
+type TokenStore interface {
+	GetPersonalAccessTokenByHash(hash string) (database.PersonalAccessToken, error)
+}
+
+// SessionStore looks up the session an access token was issued for.
+type SessionStore interface {
+	GetSession(id string) (database.Session, error)
+}
+
+// ClientStore looks up the OAuth client an access token was issued to.
+type ClientStore interface {
+	GetOAuthClient(id string) (database.OAuthClient, error)
+}
+
+// Authenticator is HTTP middleware that checks the bearer access token
+// of a request and puts the user it belongs to in the request context.
+// Routes wrapped by RequireScope also take personal access tokens and
+// the access tokens of OAuth clients.
+type Authenticator struct {
+	Keys   *KeyRing
+	Users  UserStore
+	Tokens TokenStore
+	// Sessions, if set, is checked so access tokens stop working as
+	// soon as their session is ended rather than when they expire.
+	Sessions SessionStore
+	// Clients, if set, is checked so the access tokens of an OAuth
+	// client stop working as soon as the client is deleted.
+	Clients ClientStore
+	// Error writes error responses; http.Error is used when it is nil.
+	Error func(w http.ResponseWriter, code int, msg string)
+}
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	claimsKey
+	personalAccessTokenKey
+)
+
+// UserFromContext returns the user authenticated by the middleware.
+func UserFromContext(ctx context.Context) (database.User, bool) {
+	user, ok := ctx.Value(userKey).(database.User)
+	return user, ok
+}
+
+// ClaimsFromContext returns the claims of the token the request
+// was authenticated with.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok
+}
+
+// PersonalAccessTokenFromContext returns the personal access token
+// the request was authenticated with, if it was.
+func PersonalAccessTokenFromContext(ctx context.Context) (database.PersonalAccessToken, bool) {
+	token, ok := ctx.Value(personalAccessTokenKey).(database.PersonalAccessToken)
+	return token, ok
+}
+
+// Required rejects requests without a valid access token.
+func (a *Authenticator) Required(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, ok := a.authenticate(w, r, false, "")
+		if !ok {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope is like Required, but also accepts personal access
+// tokens and OAuth access tokens that were granted scope.
+func (a *Authenticator) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, ok := a.authenticate(w, r, false, scope)
+			if !ok {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// OptionalScope is for routes anyone may use, such as reading chirps.
+// Requests without an Authorization header go through anonymously;
+// those that do send a token are held to RequireScope's rules, so an
+// invalid token, or a personal access token or OAuth access token
+// without scope, is rejected rather than ignored.
+func (a *Authenticator) OptionalScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, ok := a.authenticate(w, r, true, scope)
+			if !ok {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole rejects requests unless the authenticated user currently
+// holds one of roles.
+func (a *Authenticator) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return a.Required(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, _ := UserFromContext(r.Context())
+			if !slices.Contains(roles, user.Role) {
+				a.error(w, http.StatusForbidden, "You don't have permission to do that")
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// authenticate validates the request's access token and returns the
+// request with the user added to its context. Personal access tokens
+// and OAuth access tokens are only accepted when scope is set and they
+// hold it. It writes the error response itself and returns false when
+// the request must stop.
+func (a *Authenticator) authenticate(w http.ResponseWriter, r *http.Request, optional bool, scope string) (*http.Request, bool) {
+	token, err := GetBearerToken(r.Header)
+	if errors.Is(err, ErrNoAuthHeaderIncluded) && optional {
+		return r, true
+	}
+	if err != nil {
+		a.unauthorized(w, "Couldn't find JWT")
+		return r, false
+	}
+	if IsPersonalAccessToken(token) {
+		return a.authenticatePersonalAccessToken(w, r, token, scope)
+	}
+
+	claims, err := ValidateJWT(token, a.Keys, TokenTypeAccess)
+	if err != nil {
+		a.unauthorized(w, "Couldn't validate JWT")
+		return r, false
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		a.unauthorized(w, "Couldn't validate JWT")
+		return r, false
+	}
+	if claims.ClientID != "" {
+		if scope == "" {
+			a.error(w, http.StatusForbidden, "OAuth access tokens can't be used here")
+			return r, false
+		}
+		if !claims.HasScope(scope) {
+			a.insufficientScope(w, scope)
+			return r, false
+		}
+		if a.Clients != nil {
+			_, err := a.Clients.GetOAuthClient(claims.ClientID)
+			if errors.Is(err, database.ErrNotExist) {
+				a.unauthorized(w, "OAuth client no longer exists")
+				return r, false
+			}
+			if err != nil {
+				log.Printf("Error loading OAuth client: %s", err)
+				a.error(w, http.StatusInternalServerError, "Couldn't check OAuth client")
+				return r, false
+			}
+		}
+	}
+
+	if claims.SessionID != "" && a.Sessions != nil {
+		session, err := a.Sessions.GetSession(claims.SessionID)
+		if errors.Is(err, database.ErrNotExist) || errors.Is(err, database.ErrTokenExpired) ||
+			(err == nil && session.UserID != userID) {
+			a.unauthorized(w, "Session has ended")
+			return r, false
+		}
+		if err != nil {
+			log.Printf("Error loading session: %s", err)
+			a.error(w, http.StatusInternalServerError, "Couldn't check session")
+			return r, false
+		}
+	}
+
+	user, ok := a.loadUser(w, userID)
+	if !ok {
+		return r, false
+	}
+
+	ctx := context.WithValue(r.Context(), userKey, user)
+	ctx = context.WithValue(ctx, claimsKey, claims)
+	return r.WithContext(ctx), true
+}
+
+func (a *Authenticator) authenticatePersonalAccessToken(w http.ResponseWriter, r *http.Request, token, scope string) (*http.Request, bool) {
+	if scope == "" || a.Tokens == nil {
+		a.error(w, http.StatusForbidden, "Personal access tokens can't be used here")
+		return r, false
+	}
+
+	pat, err := a.Tokens.GetPersonalAccessTokenByHash(HashToken(token))
+	if errors.Is(err, database.ErrNotExist) || errors.Is(err, database.ErrTokenExpired) {
+		a.unauthorized(w, "Personal access token is invalid or expired")
+		return r, false
+	}
+	if err != nil {
+		log.Printf("Error loading personal access token: %s", err)
+		a.error(w, http.StatusInternalServerError, "Couldn't check personal access token")
+		return r, false
+	}
+	if !pat.HasScope(scope) {
+		a.insufficientScope(w, scope)
+		return r, false
+	}
+
+	user, ok := a.loadUser(w, pat.UserID)
+	if !ok {
+		return r, false
+	}
+
+	ctx := context.WithValue(r.Context(), userKey, user)
+	ctx = context.WithValue(ctx, personalAccessTokenKey, pat)
+	return r.WithContext(ctx), true
+}
+
+func (a *Authenticator) loadUser(w http.ResponseWriter, userID int) (database.User, bool) {
+	user, err := a.Users.GetUser(userID)
+	if errors.Is(err, database.ErrNotExist) {
+		a.unauthorized(w, "User no longer exists")
+		return database.User{}, false
+	}
+	if err != nil {
+		log.Printf("Error loading user %d: %s", userID, err)
+		a.error(w, http.StatusInternalServerError, "Couldn't get user")
+		return database.User{}, false
+	}
+	return user, true
+}
+
+func (a *Authenticator) insufficientScope(w http.ResponseWriter, scope string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="insufficient_scope", scope=%q`, scope))
+	a.error(w, http.StatusForbidden, fmt.Sprintf("Token lacks the %s scope", scope))
+}
+
+func (a *Authenticator) unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+	a.error(w, http.StatusUnauthorized, msg)
+}
+
+func (a *Authenticator) error(w http.ResponseWriter, code int, msg string) {
+	if a.Error == nil {
+		http.Error(w, msg, code)
+		return
+	}
+	a.Error(w, code, msg)
+}
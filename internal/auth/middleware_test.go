@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+type testStore struct {
+	users  map[int]database.User
+	tokens map[string]database.PersonalAccessToken
+}
+
+func (s testStore) GetUser(id int) (database.User, error) {
+	user, ok := s.users[id]
+	if !ok {
+		return database.User{}, database.ErrNotExist
+	}
+	return user, nil
+}
+
+func (s testStore) GetPersonalAccessTokenByHash(hash string) (database.PersonalAccessToken, error) {
+	token, ok := s.tokens[hash]
+	if !ok {
+		return database.PersonalAccessToken{}, database.ErrNotExist
+	}
+	return token, nil
+}
+
+func newTestAuthenticator(t *testing.T) (*Authenticator, testStore) {
+	t.Helper()
+	keys := NewKeyRing()
+	err := keys.Add(NewHMACKey("test", []byte("test secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.SetActive("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := testStore{
+		users:  map[int]database.User{1: {ID: 1, Email: "user@example.com", Role: database.RoleUser}},
+		tokens: map[string]database.PersonalAccessToken{},
+	}
+	return &Authenticator{Keys: keys, Users: store, Tokens: store}, store
+}
+
+func (s testStore) addPersonalAccessToken(t *testing.T, scopes ...string) string {
+	t.Helper()
+	token, err := NewPersonalAccessToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tokens[HashToken(token)] = database.PersonalAccessToken{
+		ID:        len(s.tokens) + 1,
+		UserID:    1,
+		Hash:      HashToken(token),
+		Scopes:    scopes,
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	return token
+}
+
+func TestOptionalScope(t *testing.T) {
+	authn, store := newTestAuthenticator(t)
+	accessToken, err := MakeAccessJWT(1, "", authn.Keys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readToken, err := MakeOAuthAccessJWT(1, "client", []string{ScopeChirpsRead}, authn.Keys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeToken, err := MakeOAuthAccessJWT(1, "client", []string{ScopeChirpsWrite}, authn.Keys, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+		wantUser bool
+	}{
+		{name: "anonymous", wantCode: http.StatusOK},
+		{name: "access token", token: accessToken, wantCode: http.StatusOK, wantUser: true},
+		{name: "personal access token with scope", token: store.addPersonalAccessToken(t, ScopeChirpsRead), wantCode: http.StatusOK, wantUser: true},
+		{name: "personal access token without scope", token: store.addPersonalAccessToken(t, ScopeChirpsWrite), wantCode: http.StatusForbidden},
+		{name: "OAuth access token with scope", token: readToken, wantCode: http.StatusOK, wantUser: true},
+		{name: "OAuth access token without scope", token: writeToken, wantCode: http.StatusForbidden},
+		{name: "invalid token", token: "not a token", wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotUser := false
+			handler := authn.OptionalScope(ScopeChirpsRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, gotUser = UserFromContext(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/chirps", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if gotUser != tt.wantUser {
+				t.Errorf("user in context: got %v, want %v", gotUser, tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OpenID Connect scopes. OAuth clients can ask for these on top of
+// Scopes: openid for an ID token and the userinfo endpoint, email for
+// the user's email address in them.
+const (
+	ScopeOpenID = "openid"
+	ScopeEmail  = "email"
+)
+
+// OAuthScopes lists every scope an OAuth client can ask for.
+var OAuthScopes = append([]string{ScopeOpenID, ScopeEmail}, Scopes...)
+
+// ValidOAuthScope reports whether an OAuth client can ask for scope.
+func ValidOAuthScope(scope string) bool {
+	return slices.Contains(OAuthScopes, scope)
+}
+
+// PKCE (RFC 7636). Only the S256 method is supported; plain would let
+// anyone who sees the authorization request redeem the code.
+const PKCEMethodS256 = "S256"
+
+// ValidPKCEVerifier reports whether verifier is 43 to 128 characters
+// from the allowed set.
+func ValidPKCEVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, c := range verifier {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// PKCEChallenge returns the S256 code challenge for verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CheckPKCE reports whether verifier belongs to the S256 challenge.
+func CheckPKCE(verifier, challenge string) bool {
+	if !ValidPKCEVerifier(verifier) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(PKCEChallenge(verifier)), []byte(challenge)) == 1
+}
+
+// IDTokenClaims are the claims of an OpenID Connect ID token.
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	AuthTime      int64  `json:"auth_time"`
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+}
+
+var ErrNoPublicKey = errors.New("ID tokens need an asymmetric signing key (JWT_KEYS_DIR)")
+
+// CanSignPublicly reports whether the active key is asymmetric, so
+// others can verify its signatures from the JWKS. ID tokens are only
+// issued then.
+func (kr *KeyRing) CanSignPublicly() bool {
+	return kr.active != nil && kr.active.Method.Alg() != jwt.SigningMethodHS256.Alg()
+}
+
+// SigningAlgorithm returns the algorithm of the active key.
+func (kr *KeyRing) SigningAlgorithm() string {
+	if kr.active == nil {
+		return ""
+	}
+	return kr.active.Method.Alg()
+}
+
+// MakeIDToken signs an ID token for user userID, issued by issuer to
+// clientID, valid for expiresIn. claims supplies the rest.
+func MakeIDToken(keys *KeyRing, issuer, clientID string, userID int, expiresIn time.Duration, claims IDTokenClaims) (string, error) {
+	if !keys.CanSignPublicly() {
+		return "", ErrNoPublicKey
+	}
+
+	now := time.Now().UTC()
+	claims.Issuer = issuer
+	claims.Subject = subject(userID)
+	claims.Audience = jwt.ClaimStrings{clientID}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(expiresIn))
+	return keys.sign(claims)
+}
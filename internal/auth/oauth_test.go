@@ -0,0 +1,35 @@
+package auth
+
+import "testing"
+
+func TestCheckPKCE(t *testing.T) {
+	// RFC 7636 Appendix B.
+	const (
+		verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	)
+
+	if got := PKCEChallenge(verifier); got != challenge {
+		t.Errorf("PKCEChallenge(%q) = %q, want %q", verifier, got, challenge)
+	}
+
+	tests := []struct {
+		name     string
+		verifier string
+		want     bool
+	}{
+		{name: "matching verifier", verifier: verifier, want: true},
+		{name: "other verifier", verifier: "eBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk", want: false},
+		{name: "empty verifier", verifier: "", want: false},
+		{name: "verifier too short", verifier: verifier[:42], want: false},
+		{name: "verifier with invalid characters", verifier: verifier[:42] + "=", want: false},
+		{name: "challenge as verifier", verifier: challenge, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckPKCE(tt.verifier, challenge); got != tt.want {
+				t.Errorf("CheckPKCE(%q) = %v, want %v", tt.verifier, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hash algorithms. Stored hashes say which one made them:
+// argon2id hashes use the PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash) and bcrypt hashes
+// their usual $2a$/$2b$ prefix.
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+// bcryptMaxLength is the longest password bcrypt looks at; it ignores
+// anything after it.
+const bcryptMaxLength = 72
+
+var (
+	ErrPasswordTooLong  = errors.New("password is too long")
+	ErrUnknownHash      = errors.New("unknown password hash format")
+	ErrPasswordMismatch = errors.New("password does not match")
+)
+
+// PasswordParams configures how new password hashes are made.
+type PasswordParams struct {
+	Algorithm string
+
+	// argon2id
+	MemoryKiB   uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+
+	// bcrypt
+	BcryptCost int
+}
+
+// DefaultPasswordParams follow the OWASP recommendations for argon2id.
+var DefaultPasswordParams = PasswordParams{
+	Algorithm:   AlgorithmArgon2id,
+	MemoryKiB:   64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+	BcryptCost:  12,
+}
+
+var passwordParams = DefaultPasswordParams
+
+// SetPasswordParams changes the parameters new hashes are made with.
+// Call it at startup, before any passwords are hashed.
+func SetPasswordParams(p PasswordParams) error {
+	switch p.Algorithm {
+	case AlgorithmArgon2id:
+		if p.MemoryKiB < 8*uint32(p.Parallelism) || p.Iterations < 1 || p.Parallelism < 1 {
+			return errors.New("invalid argon2id parameters")
+		}
+		if p.SaltLength < 16 || p.KeyLength < 16 {
+			return errors.New("argon2id salt and key must be at least 16 bytes")
+		}
+	case AlgorithmBcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hash algorithm %q", p.Algorithm)
+	}
+	passwordParams = p
+	return nil
+}
+
+func hashPassword(password string, p PasswordParams) (string, error) {
+	switch p.Algorithm {
+	case AlgorithmBcrypt:
+		if len(password) > bcryptMaxLength {
+			return "", ErrPasswordTooLong
+		}
+		dat, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(dat), nil
+	case AlgorithmArgon2id:
+		salt := make([]byte, p.SaltLength)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Iterations, p.MemoryKiB, p.Parallelism, p.KeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, p.MemoryKiB, p.Iterations, p.Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("unknown password hash algorithm %q", p.Algorithm)
+	}
+}
+
+func checkPasswordHash(password, hash string) error {
+	switch {
+	case isBcryptHash(hash):
+		// Older versions truncated long passwords; refuse them rather
+		// than accept anything sharing the first 72 bytes.
+		if len(password) > bcryptMaxLength {
+			return ErrPasswordTooLong
+		}
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrPasswordMismatch
+		}
+		return err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		p, salt, key, err := parseArgon2idHash(hash)
+		if err != nil {
+			return err
+		}
+		got := argon2.IDKey([]byte(password), salt, p.Iterations, p.MemoryKiB, p.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return ErrPasswordMismatch
+		}
+		return nil
+	default:
+		return ErrUnknownHash
+	}
+}
+
+// PasswordNeedsRehash reports whether hash was made with another
+// algorithm or other parameters than new hashes are, so it should be
+// replaced the next time the password is known.
+func PasswordNeedsRehash(hash string) bool {
+	p := passwordParams
+	switch {
+	case isBcryptHash(hash):
+		if p.Algorithm != AlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != p.BcryptCost
+	case strings.HasPrefix(hash, "$argon2id$"):
+		if p.Algorithm != AlgorithmArgon2id {
+			return true
+		}
+		stored, salt, key, err := parseArgon2idHash(hash)
+		return err != nil ||
+			stored.MemoryKiB != p.MemoryKiB ||
+			stored.Iterations != p.Iterations ||
+			stored.Parallelism != p.Parallelism ||
+			uint32(len(salt)) != p.SaltLength ||
+			uint32(len(key)) != p.KeyLength
+	default:
+		return true
+	}
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func parseArgon2idHash(hash string) (PasswordParams, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return PasswordParams{}, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return PasswordParams{}, nil, nil, ErrUnknownHash
+	}
+
+	p := PasswordParams{Algorithm: AlgorithmArgon2id}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.MemoryKiB, &p.Iterations, &p.Parallelism)
+	if err != nil || p.Iterations < 1 || p.Parallelism < 1 {
+		return PasswordParams{}, nil, nil, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return PasswordParams{}, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return PasswordParams{}, nil, nil, ErrUnknownHash
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// legacyBcryptHash is a cost 4 bcrypt hash of "04234", as stored by
+// versions of chirpy before argon2id.
+const legacyBcryptHash = "$2a$04$0XcWqCRSKfvTSy84NZ39wuRiOSjJ8r81w.tao/kiYJZyic.jTviTO"
+
+// testArgon2idParams are argon2id parameters cheap enough for tests.
+var testArgon2idParams = PasswordParams{
+	Algorithm:   AlgorithmArgon2id,
+	MemoryKiB:   64,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+var testBcryptParams = PasswordParams{
+	Algorithm:  AlgorithmBcrypt,
+	BcryptCost: 4,
+}
+
+// setTestPasswordParams makes new hashes use p until the test ends.
+func setTestPasswordParams(t *testing.T, p PasswordParams) {
+	t.Helper()
+	old := passwordParams
+	err := SetPasswordParams(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { passwordParams = old })
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	long := strings.Repeat("a", bcryptMaxLength+1)
+	argon2idHash, err := hashPassword("04234", testArgon2idParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	longArgon2idHash, err := hashPassword(long, testArgon2idParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := hashPassword(strings.Repeat("a", bcryptMaxLength), testBcryptParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		hash     string
+		wantErr  error
+	}{
+		{name: "argon2id", password: "04234", hash: argon2idHash},
+		{name: "argon2id mismatch", password: "04235", hash: argon2idHash, wantErr: ErrPasswordMismatch},
+		{name: "argon2id long password", password: long, hash: longArgon2idHash},
+		{name: "legacy bcrypt", password: "04234", hash: legacyBcryptHash},
+		{name: "legacy bcrypt mismatch", password: "04235", hash: legacyBcryptHash, wantErr: ErrPasswordMismatch},
+		{name: "bcrypt at limit", password: strings.Repeat("a", bcryptMaxLength), hash: bcryptHash},
+		// bcrypt only looks at the first 72 bytes, so this would match.
+		{name: "bcrypt too long", password: long, hash: bcryptHash, wantErr: ErrPasswordTooLong},
+		{name: "unknown hash", password: "04234", hash: "04234", wantErr: ErrUnknownHash},
+		{name: "malformed argon2id", password: "04234", hash: "$argon2id$v=19$m=64,t=1,p=1$", wantErr: ErrUnknownHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckPasswordHash(tt.password, tt.hash)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("CheckPasswordHash = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	long := strings.Repeat("a", bcryptMaxLength+1)
+
+	tests := []struct {
+		name       string
+		params     PasswordParams
+		password   string
+		wantPrefix string
+		wantErr    error
+	}{
+		{name: "argon2id", params: testArgon2idParams, password: "04234", wantPrefix: "$argon2id$v=19$m=64,t=1,p=1$"},
+		{name: "argon2id long password", params: testArgon2idParams, password: long, wantPrefix: "$argon2id$"},
+		{name: "bcrypt", params: testBcryptParams, password: "04234", wantPrefix: "$2a$04$"},
+		{name: "bcrypt too long", params: testBcryptParams, password: long, wantErr: ErrPasswordTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestPasswordParams(t, tt.params)
+			hash, err := HashPassword(tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("HashPassword error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(hash, tt.wantPrefix) {
+				t.Errorf("hash %s doesn't start with %s", hash, tt.wantPrefix)
+			}
+			err = CheckPasswordHash(tt.password, hash)
+			if err != nil {
+				t.Errorf("CheckPasswordHash of the new hash: %v", err)
+			}
+			if PasswordNeedsRehash(hash) {
+				t.Error("new hash needs rehashing")
+			}
+		})
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	argon2idHash, err := hashPassword("04234", testArgon2idParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with returns the argon2id test parameters changed by change.
+	with := func(change func(p *PasswordParams)) PasswordParams {
+		p := testArgon2idParams
+		change(&p)
+		return p
+	}
+	tests := []struct {
+		name   string
+		params PasswordParams
+		hash   string
+		want   bool
+	}{
+		{name: "argon2id unchanged", params: testArgon2idParams, hash: argon2idHash, want: false},
+		{name: "argon2id to bcrypt", params: testBcryptParams, hash: argon2idHash, want: true},
+		{name: "bcrypt to argon2id", params: testArgon2idParams, hash: legacyBcryptHash, want: true},
+		{name: "bcrypt unchanged", params: testBcryptParams, hash: legacyBcryptHash, want: false},
+		{name: "bcrypt cost", params: PasswordParams{Algorithm: AlgorithmBcrypt, BcryptCost: 5}, hash: legacyBcryptHash, want: true},
+		{name: "argon2id memory", params: with(func(p *PasswordParams) { p.MemoryKiB = 128 }), hash: argon2idHash, want: true},
+		{name: "argon2id iterations", params: with(func(p *PasswordParams) { p.Iterations = 2 }), hash: argon2idHash, want: true},
+		{name: "argon2id parallelism", params: with(func(p *PasswordParams) { p.Parallelism = 2 }), hash: argon2idHash, want: true},
+		{name: "argon2id key length", params: with(func(p *PasswordParams) { p.KeyLength = 16 }), hash: argon2idHash, want: true},
+		{name: "unknown hash", params: testArgon2idParams, hash: "04234", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestPasswordParams(t, tt.params)
+			got := PasswordNeedsRehash(tt.hash)
+			if got != tt.want {
+				t.Errorf("PasswordNeedsRehash = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgon2idHash(t *testing.T) {
+	const salt = "c2FsdHNhbHRzYWx0c2FsdA"
+	const key = "a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{name: "valid", hash: "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key},
+		{name: "missing key", hash: "$argon2id$v=19$m=64,t=1,p=1$" + salt, wantErr: true},
+		{name: "extra field", hash: "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "$x", wantErr: true},
+		{name: "old version", hash: "$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "no version", hash: "$argon2id$19$m=64,t=1,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "missing parameter", hash: "$argon2id$v=19$m=64,t=1$" + salt + "$" + key, wantErr: true},
+		{name: "zero iterations", hash: "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "zero parallelism", hash: "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key, wantErr: true},
+		{name: "non-numeric memory", hash: "$argon2id$v=19$m=x,t=1,p=1$" + salt + "$" + key, wantErr: true},
+		{name: "bad salt", hash: "$argon2id$v=19$m=64,t=1,p=1$!!!$" + key, wantErr: true},
+		{name: "padded key", hash: "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + key + "=", wantErr: true},
+		{name: "empty key", hash: "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, _, err := parseArgon2idHash(tt.hash)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("parseArgon2idHash error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (p.MemoryKiB != 64 || p.Iterations != 1 || p.Parallelism != 1 || p.SaltLength != 16 || p.KeyLength != 32) {
+				t.Errorf("parsed params = %+v", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"slices"
+	"strings"
+)
+
+// PersonalAccessTokenPrefix starts every personal access token, so
+// they can be told apart from JWTs and spotted by secret scanners.
+const PersonalAccessTokenPrefix = "chirpy_pat_"
+
+// Scopes a personal access token can be granted. Routes that accept
+// personal access tokens name the scope they need; all others only
+// accept access tokens from logging in.
+const (
+	ScopeChirpsRead  = "chirps:read"
+	ScopeChirpsWrite = "chirps:write"
+	ScopeUsersRead   = "users:read"
+)
+
+// Scopes lists every scope there is.
+var Scopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeUsersRead}
+
+// ValidScope reports whether scope exists.
+func ValidScope(scope string) bool {
+	return slices.Contains(Scopes, scope)
+}
+
+// NewPersonalAccessToken returns a new random personal access token.
+// Store it by HashToken.
+func NewPersonalAccessToken() (string, error) {
+	id, err := NewTokenID()
+	if err != nil {
+		return "", err
+	}
+	return PersonalAccessTokenPrefix + id, nil
+}
+
+// IsPersonalAccessToken reports whether token looks like a personal
+// access token rather than a JWT.
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
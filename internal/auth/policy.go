@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy is what new passwords must satisfy.
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is how many of the character classes (lower case,
+	// upper case, digits, other) a password must mix.
+	MinClasses int
+	// DisallowEmail rejects passwords that are the user's email
+	// address or its part before the @.
+	DisallowEmail bool
+	// Breached, if set, rejects passwords known from data breaches.
+	Breached *BreachedPasswords
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:     8,
+	DisallowEmail: true,
+}
+
+// PolicyViolation is one rule a password broke.
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Check returns the rules password breaks for the user with email;
+// none means it is acceptable.
+func (p PasswordPolicy) Check(password, email string) ([]PolicyViolation, error) {
+	violations := []PolicyViolation{}
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		violations = append(violations, PolicyViolation{
+			Rule:    "min_length",
+			Message: fmt.Sprintf("must be at least %d characters long", p.MinLength),
+		})
+	}
+
+	if classes := characterClasses(password); classes < p.MinClasses {
+		violations = append(violations, PolicyViolation{
+			Rule:    "character_classes",
+			Message: fmt.Sprintf("must mix at least %d of lower case letters, upper case letters, digits and symbols", p.MinClasses),
+		})
+	}
+
+	if p.DisallowEmail && email != "" {
+		lowered := strings.ToLower(password)
+		local, _, _ := strings.Cut(strings.ToLower(email), "@")
+		if lowered == strings.ToLower(email) || lowered == local {
+			violations = append(violations, PolicyViolation{
+				Rule:    "not_email",
+				Message: "must not be your email address",
+			})
+		}
+	}
+
+	if p.Breached != nil && password != "" {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violations = append(violations, PolicyViolation{
+				Rule:    "breached",
+				Message: "appears in a known data breach; choose another one",
+			})
+		}
+	}
+
+	return violations, nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	n := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			n++
+		}
+	}
+	return n
+}
+
+// BreachedPasswords looks passwords up in a local copy of a breached
+// password corpus laid out like the Pwned Passwords range API: one
+// file per 5 hex digit SHA-1 prefix (e.g. "21BD1" or "21BD1.txt"),
+// each listing the remaining 35 digits of every hash as
+// "SUFFIX:COUNT" lines. A lookup only reads the one file for the
+// password's prefix.
+type BreachedPasswords struct {
+	dir string
+}
+
+// NewBreachedPasswords uses the range files in dir.
+func NewBreachedPasswords(dir string) (*BreachedPasswords, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &BreachedPasswords{dir: dir}, nil
+}
+
+// Contains reports whether password is in the corpus.
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(b.dir, prefix))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238): HMAC-SHA1, 6 digits, 30 second steps.
+// These are the defaults every authenticator app supports.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many steps either side of now are accepted,
+	// to allow for clock drift and slow typing.
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random 160-bit secret in base32.
+func NewTOTPSecret() (string, error) {
+	dat := make([]byte, 20)
+	_, err := rand.Read(dat)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(dat), nil
+}
+
+// TOTPURI returns the otpauth:// URI authenticator apps read from a
+// QR code to add the account.
+func TOTPURI(secret, account string) string {
+	label := url.PathEscape(Issuer + ":" + account)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", Issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// TOTPStep returns the time step t falls in.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// TOTPCode returns the code for secret at time step step.
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation (RFC 4226, section 5.3).
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// ValidateTOTP checks code against secret around time now. It returns
+// the time step the code belongs to, so callers can refuse to accept
+// the same step twice.
+func ValidateTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := TOTPStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes returns n random single-use recovery codes
+// like "abcd-efgh-ijkl-mnop" (80 bits each).
+func NewRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		dat := make([]byte, 10)
+		_, err := rand.Read(dat)
+		if err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(dat))
+		codes = append(codes, s[0:4]+"-"+s[4:8]+"-"+s[8:12]+"-"+s[12:16])
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode returns the hash a recovery code is stored under.
+// Case and dashes don't matter when typing a code in.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return HashToken(code)
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of RFC 6238 Appendix B,
+// "12345678901234567890", in base32.
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B gives 8-digit codes; ours are their last 6.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "94287082"},
+		{unix: 1111111109, want: "07081804"},
+		{unix: 1111111111, want: "14050471"},
+		{unix: 1234567890, want: "89005924"},
+		{unix: 2000000000, want: "69279037"},
+		{unix: 20000000000, want: "65353130"},
+	}
+	for _, tt := range tests {
+		want := tt.want[len(tt.want)-totpDigits:]
+		got, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	// 1111111109 is step 37037036, the code there 081804.
+	now := time.Unix(1111111109, 0)
+	step := TOTPStep(now)
+	code, err := TOTPCode(rfc6238Secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		code     string
+		wantOK   bool
+		wantStep int64
+	}{
+		{name: "current step", at: now, code: code, wantOK: true, wantStep: step},
+		{name: "with spaces", at: now, code: " " + code[:3] + " " + code[3:], wantOK: true, wantStep: step},
+		{name: "one step late", at: now.Add(totpPeriod * time.Second), code: code, wantOK: true, wantStep: step},
+		{name: "one step early", at: now.Add(-totpPeriod * time.Second), code: code, wantOK: true, wantStep: step},
+		{name: "two steps late", at: now.Add(2 * totpPeriod * time.Second), code: code, wantOK: false},
+		{name: "two steps early", at: now.Add(-2 * totpPeriod * time.Second), code: code, wantOK: false},
+		{name: "wrong code", at: now, code: "000000", wantOK: false},
+		{name: "8 digits", at: now, code: "07081804", wantOK: false},
+		{name: "empty", at: now, code: "", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := ValidateTOTP(rfc6238Secret, tt.code, tt.at)
+			if ok != tt.wantOK {
+				t.Fatalf("ValidateTOTP(%q) ok = %v, want %v", tt.code, ok, tt.wantOK)
+			}
+			if ok && gotStep != tt.wantStep {
+				t.Errorf("ValidateTOTP(%q) step = %d, want %d", tt.code, gotStep, tt.wantStep)
+			}
+		})
+	}
+}
@@ -3,20 +3,53 @@ package database
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var ErrNotExist = errors.New("resource does not exist")
 
+// defaultCompactThreshold is the log size that triggers a background
+// compaction of the log into a fresh snapshot.
+const defaultCompactThreshold = 1 << 20
+
+// compactLockRetry is how long a finished compaction waits for readers
+// holding the file lock before trying again to swap in its result.
+const compactLockRetry = 10 * time.Millisecond
+
 // 5. Storage / 1. Storage
 // Keep your entire "database" in a single file called database.json
 // To make sure
 // that multiple requests don't try to write to the database at the same time,
 // you should use a mutex to lock the database while you're using it.
+//
+// database.json is a snapshot; mutations since the snapshot are appended
+// to database.json.log and folded back into the snapshot by compaction.
+// The decoded data is kept in memory, so reads never touch the disk.
 type DB struct {
 	path string
 	mu   *sync.RWMutex
+	data *DBStructure
+	// snapshotInfo is the snapshot as last written or read by us,
+	// used by Watch to notice outside changes.
+	snapshotInfo os.FileInfo
+
+	logFile          *os.File
+	filesLock        *os.File
+	ownerLock        *os.File
+	logSize          int64
+	compactThreshold int64
+	compacting       atomic.Bool
+	compactions      sync.WaitGroup
+	// generation changes whenever writeDB replaces the snapshot,
+	// so a compaction that raced with it knows to discard its result.
+	generation uint64
 }
 
 // 5. Storage / 1. Storage
@@ -25,10 +58,78 @@ type DB struct {
 // update the data, and
 // then write the entire thing back to disk (marshal it back into JSON).
 type DBStructure struct {
+	SchemaVersion int `json:"schema_version"`
+
 	Chirps map[int]Chirp `json:"chirps"`
 	// 5. Storage / 7. Users
 	Users map[int]User `json:"users"`
-	// Revocations map[string]Revocation `json:"revocations"`
+
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+
+	UserTokens map[string]UserToken `json:"user_tokens"`
+
+	TOTP map[int]TOTP `json:"totp"`
+
+	PersonalAccessTokens map[int]PersonalAccessToken `json:"personal_access_tokens"`
+
+	Sessions map[string]Session `json:"sessions"`
+
+	OAuthClients map[string]OAuthClient `json:"oauth_clients"`
+	OAuthCodes   map[string]OAuthCode   `json:"oauth_codes"`
+
+	// Sequences holds the last ID handed out per collection.
+	Sequences map[string]int `json:"sequences"`
+}
+
+// Collection names, shared by the snapshot's JSON fields and log records.
+const (
+	collChirps    = "chirps"
+	collUsers     = "users"
+	collSequences = "sequences"
+
+	collRefreshTokens = "refresh_tokens"
+	collUserTokens    = "user_tokens"
+	collTOTP          = "totp"
+
+	collPersonalAccessTokens = "personal_access_tokens"
+	collSessions             = "sessions"
+	collOAuthClients         = "oauth_clients"
+	collOAuthCodes           = "oauth_codes"
+)
+
+// ensureCollections replaces missing collections with empty maps,
+// so older snapshots without a collection can still be written to.
+func (dbStructure *DBStructure) ensureCollections() {
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = map[int]Chirp{}
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = map[int]User{}
+	}
+	if dbStructure.Sequences == nil {
+		dbStructure.Sequences = map[string]int{}
+	}
+	if dbStructure.RefreshTokens == nil {
+		dbStructure.RefreshTokens = map[string]RefreshToken{}
+	}
+	if dbStructure.UserTokens == nil {
+		dbStructure.UserTokens = map[string]UserToken{}
+	}
+	if dbStructure.TOTP == nil {
+		dbStructure.TOTP = map[int]TOTP{}
+	}
+	if dbStructure.PersonalAccessTokens == nil {
+		dbStructure.PersonalAccessTokens = map[int]PersonalAccessToken{}
+	}
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = map[string]Session{}
+	}
+	if dbStructure.OAuthClients == nil {
+		dbStructure.OAuthClients = map[string]OAuthClient{}
+	}
+	if dbStructure.OAuthCodes == nil {
+		dbStructure.OAuthCodes = map[string]OAuthCode{}
+	}
 }
 
 // 5. Storage / 1. Storage
@@ -36,76 +137,602 @@ type DBStructure struct {
 // and creates the database file if it doesn't exist
 func NewDB(path string) (*DB, error) {
 	db := &DB{
-		path: path,
-		mu:   &sync.RWMutex{},
+		path:             path,
+		mu:               &sync.RWMutex{},
+		compactThreshold: defaultCompactThreshold,
 	}
 	err := db.ensureDB()
+	if err != nil {
+		// Let go of the files, so the database can be opened again.
+		db.Close()
+	}
 	return db, err
 }
 
+func (db *DB) logPath() string {
+	return db.path + ".log"
+}
+
+// oldLogPath holds the log while it is being compacted.
+// readDocument and MigrateTo rely on these names too.
+func (db *DB) oldLogPath() string {
+	return db.path + ".log.old"
+}
+
 func (db *DB) createDB() error {
+	return db.writeDB(emptyDBStructure())
+}
+
+func emptyDBStructure() DBStructure {
 	dbStructure := DBStructure{
-		Chirps: map[int]Chirp{},
-		Users:  map[int]User{},
-		// Revocations: map[string]Revocation{},
+		SchemaVersion: LatestSchemaVersion(),
 	}
-	return db.writeDB(dbStructure)
+	dbStructure.ensureCollections()
+	return dbStructure
 }
 
 // 5. Storage / 1. Storage
 // ensureDB creates a new database file if it doesn't exist
 func (db *DB) ensureDB() error {
-	_, err := os.ReadFile(db.path)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var err error
+	db.ownerLock, err = lockOwner(db.path)
+	if err != nil {
+		return err
+	}
+	db.filesLock, err = openLockFile(db.path)
+	if err != nil {
+		return err
+	}
+	err = db.openLog()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(db.path)
 	if errors.Is(err, os.ErrNotExist) {
 		return db.createDB()
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	err = db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	// A compaction was interrupted after the log was rotated;
+	// its old log has been replayed and is compacted now.
+	_, err = os.Stat(db.oldLogPath())
+	if err == nil {
+		db.startCompaction()
+	}
+	return nil
+}
+
+// View runs fn with read access to the in-memory database.
+// fn must not modify dbStructure or keep references into it.
+func (db *DB) View(fn func(dbStructure *DBStructure) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return fn(db.data)
+}
+
+// Update runs fn as a single read-modify-write transaction.
+// The write lock is held from the start of fn until its changes are
+// appended to the log and synced to disk, so concurrent writers can't
+// overwrite each other's changes. fn modifies the in-memory data
+// directly; if it fails, or the log can't be written, its changes
+// are rolled back and nothing is written.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx := &Tx{DBStructure: db.data}
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	err = db.appendLog(tx.records)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	db.maybeCompact()
+	return nil
 }
 
 // 5. Storage / 1. Storage
-// writeDB writes the database file to disk
+// writeDB writes the database file to disk.
+// The whole structure becomes the new snapshot and the logs are
+// cleared. Callers must hold the write lock.
 func (db *DB) writeDB(dbStructure DBStructure) error {
+	err := db.lockFiles()
+	if err != nil {
+		return err
+	}
+	defer db.unlockFiles()
+
+	return db.writeSnapshot(dbStructure)
+}
+
+// writeSnapshot is writeDB for callers that hold the file lock too.
+func (db *DB) writeSnapshot(dbStructure DBStructure) error {
+	doc, err := newDocument(dbStructure)
+	if err != nil {
+		return err
+	}
+
+	dat, err := doc.marshal()
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(db.path, dat)
+	if err != nil {
+		return err
+	}
+	db.generation++
+	db.data = &dbStructure
+	db.snapshotInfo, err = os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+
+	return db.clearLogs()
+}
+
+func writeFileAtomic(path string, dat []byte) error {
+	tmpPath, err := writeTempFile(path, dat)
+	if err != nil {
+		return err
+	}
+	return commitTempFile(tmpPath, path)
+}
+
+// writeTempFile writes dat to a synced temporary file next to path.
+func writeTempFile(path string, dat []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tmp.Write(dat)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// commitTempFile renames the temporary file over path, so a crash
+// never leaves a half-written file behind.
+func commitTempFile(tmpPath, path string) error {
+	err := os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir persists renames and removals in dir.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (db *DB) ResetDB() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	dat, err := json.Marshal(dbStructure)
+	err := db.lockFiles()
 	if err != nil {
 		return err
 	}
+	defer db.unlockFiles()
 
-	err = os.WriteFile(db.path, dat, 0600)
+	// Logs go first, so a crash can't replay them onto the empty snapshot.
+	err = db.clearLogs()
 	if err != nil {
 		return err
 	}
+	err = os.Remove(db.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return db.writeSnapshot(emptyDBStructure())
+}
 
+// 5. Storage / 1. Storage
+// loadDB reads the database file into memory, replaying the logs on top
+// of the snapshot and running any pending migrations. A migrated
+// database is written back as a new snapshot.
+// Callers must hold the write lock.
+func (db *DB) loadDB() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	doc, err := readDocument(db.path)
+	if err != nil {
+		return err
+	}
+	db.snapshotInfo = info
+
+	migrated, err := doc.migrate(LatestSchemaVersion())
+	if err != nil {
+		return err
+	}
+
+	dbStructure, err := doc.decode()
+	if err != nil {
+		return err
+	}
+	if migrated {
+		return db.writeDB(dbStructure)
+	}
+	db.data = &dbStructure
 	return nil
 }
 
-func (db *DB) ResetDB() error {
-	err := os.Remove(db.path)
+// readDocument reads the snapshot at path and replays its logs.
+func readDocument(path string) (document, error) {
+	doc, err := readSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	testHookFileRead(path)
+
+	for _, logPath := range []string{path + ".log.old", path + ".log"} {
+		err = doc.replayLog(logPath)
+		if err != nil {
+			return nil, err
+		}
+		testHookFileRead(logPath)
+	}
+	return doc, nil
+}
+
+// testHookFileRead is called by readDocument after each file it reads,
+// so tests can change the files in between.
+var testHookFileRead = func(path string) {}
+
+var errLocked = errors.New("database files are locked")
+
+// lockPath is the advisory lock that keeps outside readers, such as
+// `chirpy backup`, from seeing the files halfway through a change.
+// Readers take it shared; the server takes it exclusively to rotate
+// the log, commit a compaction or replace the snapshot.
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+func openLockFile(path string) (*os.File, error) {
+	return os.OpenFile(lockPath(path), os.O_RDONLY|os.O_CREATE, 0600)
+}
+
+// ErrDatabaseInUse is returned when another process, such as a running
+// server, has the JSON database open.
+var ErrDatabaseInUse = errors.New("database is in use by another process; stop the server first")
+
+// lockOwner takes the lock that the one process using the JSON database
+// at path holds for as long as it does. Appends to the log aren't
+// coordinated between processes, so a second one writing alongside
+// would overwrite records or compact the log away under the first.
+func lockOwner(path string) (*os.File, error) {
+	lock, err := os.OpenFile(path+".owner.lock", os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(lock, true, false)
+	if errors.Is(err, errLocked) {
+		err = ErrDatabaseInUse
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// readDocumentLocked reads the database at path like readDocument,
+// holding the shared lock so a server using it can't rotate or compact
+// the log meanwhile.
+func readDocumentLocked(path string) (document, error) {
+	lock, err := openLockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	err = lockFile(lock, false, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockFile(lock)
+
+	return readDocument(path)
+}
+
+// lockFiles takes the exclusive file lock, waiting for readers.
+// Callers must hold the write lock.
+func (db *DB) lockFiles() error {
+	return lockFile(db.filesLock, true, true)
+}
+
+// tryLockFiles takes the exclusive file lock if no reader holds it.
+// Callers must hold the write lock.
+func (db *DB) tryLockFiles() error {
+	return lockFile(db.filesLock, true, false)
+}
+
+func (db *DB) unlockFiles() {
+	err := unlockFile(db.filesLock)
+	if err != nil {
+		log.Printf("database: couldn't unlock %s: %s", lockPath(db.path), err)
+	}
+}
+
+// maybeCompact starts a background compaction once the log
+// has grown past the threshold. Callers must hold the write lock.
+func (db *DB) maybeCompact() {
+	if db.logSize < db.compactThreshold {
+		return
+	}
+	db.startCompaction()
+}
+
+// startCompaction compacts the log in the background unless a
+// compaction is already running. Callers must hold the write lock.
+func (db *DB) startCompaction() {
+	if !db.compacting.CompareAndSwap(false, true) {
+		return
+	}
+
+	// Writers append to a fresh log while the old one is compacted.
+	// A log left over from an interrupted compaction is compacted
+	// first instead. While a reader holds the file lock, rotating
+	// waits for a later transaction.
+	_, err := os.Stat(db.oldLogPath())
 	if errors.Is(err, os.ErrNotExist) {
+		err = db.tryLockFiles()
+		if errors.Is(err, errLocked) {
+			db.compacting.Store(false)
+			return
+		}
+		if err == nil {
+			err = db.rotateLog()
+			db.unlockFiles()
+		}
+	}
+	if err != nil {
+		db.compacting.Store(false)
+		log.Printf("database: couldn't rotate log: %s", err)
+		return
+	}
+
+	generation := db.generation
+	db.compactions.Add(1)
+	go func() {
+		defer db.compactions.Done()
+		defer db.compacting.Store(false)
+		err := db.compact(generation)
+		if err != nil {
+			log.Printf("database: compaction failed: %s", err)
+		}
+	}()
+}
+
+// compact folds the old log into a new snapshot. Only compaction writes
+// to the snapshot and old log, so they are read without the lock;
+// the lock is only taken to swap in the result. Writers aren't held
+// up while a reader holds the file lock: the lock is given back
+// between attempts to take the file lock.
+func (db *DB) compact(generation uint64) error {
+	doc, err := readSnapshot(db.path)
+	if err != nil {
+		return err
+	}
+	err = doc.replayLog(db.oldLogPath())
+	if err != nil {
+		return err
+	}
+
+	dat, err := doc.marshal()
+	if err != nil {
+		return err
+	}
+	tmpPath, err := writeTempFile(db.path, dat)
+	if err != nil {
+		return err
+	}
+
+	for {
+		db.mu.Lock()
+		err = db.tryLockFiles()
+		if err == nil {
+			break
+		}
+		db.mu.Unlock()
+		if !errors.Is(err, errLocked) {
+			os.Remove(tmpPath)
+			return err
+		}
+		time.Sleep(compactLockRetry)
+	}
+	defer db.mu.Unlock()
+	defer db.unlockFiles()
+
+	if db.generation != generation {
+		os.Remove(tmpPath)
 		return nil
 	}
-	return db.ensureDB()
+	err = commitTempFile(tmpPath, db.path)
+	if err != nil {
+		return err
+	}
+	db.snapshotInfo, err = os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(db.oldLogPath())
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(db.path))
 }
 
-// 5. Storage / 1. Storage
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// Close waits for a running compaction and closes the log and lock
+// files.
+func (db *DB) Close() error {
+	// A transaction may start another compaction until the write
+	// lock is held with none running.
+	for {
+		db.compactions.Wait()
+		db.mu.Lock()
+		if !db.compacting.Load() {
+			break
+		}
+		db.mu.Unlock()
+	}
+	defer db.mu.Unlock()
 
-	dbStructure := DBStructure{}
+	var err error
+	if db.logFile != nil {
+		err = db.logFile.Close()
+		db.logFile = nil
+	}
+	if db.filesLock != nil {
+		if closeErr := db.filesLock.Close(); err == nil {
+			err = closeErr
+		}
+		db.filesLock = nil
+	}
+	if db.ownerLock != nil {
+		if closeErr := db.ownerLock.Close(); err == nil {
+			err = closeErr
+		}
+		db.ownerLock = nil
+	}
+	return err
+}
 
-	dat, err := os.ReadFile(db.path)
-	if errors.Is(err, os.ErrNotExist) {
-		return dbStructure, err
+// Backup writes a consistent copy of the database to w.
+// Writers are blocked only while the in-memory data is encoded.
+func (db *DB) Backup(w io.Writer) error {
+	db.mu.RLock()
+	dat, err := json.Marshal(db.data)
+	db.mu.RUnlock()
+	if err != nil {
+		return err
 	}
 
-	err = json.Unmarshal(dat, &dbStructure)
+	_, err = w.Write(dat)
+	return err
+}
+
+// Restore replaces the whole database with a backup written by Backup.
+// Backups from older schema versions are migrated first.
+func (db *DB) Restore(r io.Reader) error {
+	dbStructure, err := readBackup(r)
 	if err != nil {
-		return dbStructure, err
+		return err
 	}
 
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.writeDB(dbStructure)
+}
+
+// readBackup reads a backup written by Backup and migrates it to the
+// latest schema version.
+func readBackup(r io.Reader) (DBStructure, error) {
+	dat, err := io.ReadAll(r)
+	if err != nil {
+		return DBStructure{}, err
+	}
+	doc, err := parseDocument(dat)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("invalid backup: %w", err)
+	}
+	_, err = doc.migrate(LatestSchemaVersion())
+	if err != nil {
+		return DBStructure{}, err
+	}
+	dbStructure, err := doc.decode()
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("invalid backup: %w", err)
+	}
 	return dbStructure, nil
 }
+
+// restoreJSONFile replaces the JSON database at path with a backup
+// without reading the current files.
+func restoreJSONFile(path string, r io.Reader) error {
+	dbStructure, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+	doc, err := newDocument(dbStructure)
+	if err != nil {
+		return err
+	}
+	dat, err := doc.marshal()
+	if err != nil {
+		return err
+	}
+	return replaceFiles(path, dat)
+}
+
+// replaceFiles makes dat the snapshot of the JSON database at path and
+// drops its logs, holding the exclusive file lock so backups don't see
+// the snapshot without the logs it replaced. It fails with
+// ErrDatabaseInUse while another process has the database open.
+func replaceFiles(path string, dat []byte) error {
+	owner, err := lockOwner(path)
+	if err != nil {
+		return err
+	}
+	defer owner.Close()
+
+	lock, err := openLockFile(path)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	err = lockFile(lock, true, true)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	err = writeFileAtomic(path, dat)
+	if err != nil {
+		return err
+	}
+	for _, logPath := range []string{path + ".log.old", path + ".log"} {
+		err = os.Remove(logPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,455 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestDB opens a JSON database in a fresh directory that compacts
+// once its log passes threshold bytes.
+func newTestDB(t *testing.T, threshold int64) (*DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("NewDB: %v", err)
+	}
+	db.compactThreshold = threshold
+	t.Cleanup(func() { closeTestDB(t, db) })
+	return db, path
+}
+
+// closeTestDB waits for any compaction in flight and closes the log,
+// so the files can be reopened as they would be after a restart.
+func closeTestDB(t *testing.T, db *DB) {
+	t.Helper()
+	err := db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForCompaction(t *testing.T, db *DB) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for db.compacting.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("compaction didn't finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func reopenTestDB(t *testing.T, db *DB, path string) *DB {
+	t.Helper()
+	closeTestDB(t, db)
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	t.Cleanup(func() { closeTestDB(t, reopened) })
+	return reopened
+}
+
+// TestConcurrentWriters runs many writers at once, with compactions
+// going on in the background, and checks that after a reopen every
+// write is there exactly once.
+func TestConcurrentWriters(t *testing.T) {
+	const (
+		writers          = 16
+		chirpsPerWriter  = 50
+		deleteEveryNth   = 3
+		counterPerWriter = 25
+	)
+
+	db, path := newTestDB(t, 2048)
+
+	var mu sync.Mutex
+	kept := map[int]string{}
+	deleted := map[int]bool{}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < chirpsPerWriter; i++ {
+				body := fmt.Sprintf("writer %d chirp %d", w, i)
+				chirp, err := db.CreateChirp(body, w)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if i%deleteEveryNth == 0 {
+					err = db.DeleteChirp(chirp.ID)
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+
+				mu.Lock()
+				if _, ok := kept[chirp.ID]; ok || deleted[chirp.ID] {
+					mu.Unlock()
+					errs <- fmt.Errorf("chirp ID %d handed out twice", chirp.ID)
+					return
+				}
+				if i%deleteEveryNth == 0 {
+					deleted[chirp.ID] = true
+				} else {
+					kept[chirp.ID] = body
+				}
+				mu.Unlock()
+			}
+
+			// A read-modify-write of one shared value loses
+			// increments unless transactions are serialised.
+			for i := 0; i < counterPerWriter; i++ {
+				err := db.Update(func(tx *Tx) error {
+					return put(tx, collSequences, tx.Sequences, "test_counter", tx.Sequences["test_counter"]+1)
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// The threshold is low enough that the log must have been
+	// folded into the snapshot along the way.
+	waitForCompaction(t, db)
+	snapshot, err := readSnapshot(path)
+	if err != nil {
+		t.Fatalf("reading snapshot: %v", err)
+	}
+	if len(snapshot.collection(collChirps)) == 0 {
+		t.Error("no compaction happened; lower the threshold")
+	}
+
+	checkWrites := func(name string, db *DB) {
+		chirps, err := db.GetChirps()
+		if err != nil {
+			t.Fatalf("%s: GetChirps: %v", name, err)
+		}
+		if len(chirps) != len(kept) {
+			t.Errorf("%s: got %d chirps, want %d", name, len(chirps), len(kept))
+		}
+		for _, chirp := range chirps {
+			if kept[chirp.ID] != chirp.Body {
+				t.Errorf("%s: chirp %d has body %q, want %q", name, chirp.ID, chirp.Body, kept[chirp.ID])
+			}
+		}
+
+		db.View(func(dbStructure *DBStructure) error {
+			if got, want := dbStructure.Sequences["test_counter"], writers*counterPerWriter; got != want {
+				t.Errorf("%s: counter is %d, want %d", name, got, want)
+			}
+			if got, want := dbStructure.Sequences[seqChirps], writers*chirpsPerWriter; got != want {
+				t.Errorf("%s: chirp sequence is %d, want %d", name, got, want)
+			}
+			return nil
+		})
+	}
+	checkWrites("before reopen", db)
+	checkWrites("after reopen", reopenTestDB(t, db, path))
+}
+
+// TestBackupFileDuringCompaction backs the database up from its files,
+// as `chirpy backup` does, while writers keep rotating and compacting
+// the log. Every transaction hands out the next chirp ID and stores
+// that chirp, so a consistent copy holds exactly chirps 1 to the
+// sequence; a transaction that fell out of the copy leaves a gap.
+func TestBackupFileDuringCompaction(t *testing.T) {
+	db, path := newTestDB(t, 16<<10)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, err := db.CreateChirp("chirp", 1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Keep backing up until the log has been rotated and compacted
+	// a good number of times underneath the backups.
+	for i := 0; ; i++ {
+		var seq int
+		db.View(func(dbStructure *DBStructure) error {
+			seq = dbStructure.Sequences[seqChirps]
+			return nil
+		})
+		if seq >= 3000 {
+			break
+		}
+
+		buf := &bytes.Buffer{}
+		err := BackupFile(DriverJSON, path, buf)
+		if err != nil {
+			t.Fatalf("backup %d: %v", i, err)
+		}
+		seq = checkBackup(t, buf.Bytes())
+	}
+}
+
+// checkBackup checks that a backup holds exactly chirps 1 to its
+// chirp sequence and returns the sequence.
+func checkBackup(t *testing.T, dat []byte) int {
+	t.Helper()
+	doc, err := parseDocument(dat)
+	if err != nil {
+		t.Fatalf("parsing backup: %v", err)
+	}
+	backup, err := doc.decode()
+	if err != nil {
+		t.Fatalf("decoding backup: %v", err)
+	}
+
+	seq := backup.Sequences[seqChirps]
+	if len(backup.Chirps) != seq {
+		t.Fatalf("backup has %d chirps but the sequence is at %d", len(backup.Chirps), seq)
+	}
+	for id := 1; id <= seq; id++ {
+		if _, ok := backup.Chirps[id]; !ok {
+			t.Fatalf("backup lacks chirp %d", id)
+		}
+	}
+	return seq
+}
+
+// TestBackupFileHoldsOffCompaction tries to compact or rotate the log
+// in the windows between the files BackupFile reads, where either would
+// make the copy lose transactions, and checks that they wait for it.
+func TestBackupFileHoldsOffCompaction(t *testing.T) {
+	createChirps := func(t *testing.T, db *DB, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			_, err := db.CreateChirp("chirp", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, db *DB)
+		// interfere runs once, after BackupFile has read the file
+		// at path. It returns a channel that yields once it is done.
+		interfere func(t *testing.T, db *DB, path string) <-chan error
+	}{
+		{
+			// The old snapshot was read; the old log it replaces
+			// would be gone by the time it is read.
+			name: "compaction after the snapshot is read",
+			setup: func(t *testing.T, db *DB) {
+				createChirps(t, db, 5)
+				db.mu.Lock()
+				err := db.rotateLog()
+				db.mu.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+				createChirps(t, db, 2)
+			},
+			interfere: func(t *testing.T, db *DB, path string) <-chan error {
+				if path != db.path {
+					return nil
+				}
+				done := make(chan error, 1)
+				go func() { done <- db.compact(db.generation) }()
+				// Give the compaction time to land if it could.
+				time.Sleep(100 * time.Millisecond)
+				return done
+			},
+		},
+		{
+			// There was no old log to read, and the log read next
+			// would be a fresh one.
+			name: "rotation after the old log is looked for",
+			setup: func(t *testing.T, db *DB) {
+				createChirps(t, db, 5)
+			},
+			interfere: func(t *testing.T, db *DB, path string) <-chan error {
+				if path != db.oldLogPath() {
+					return nil
+				}
+				db.mu.Lock()
+				db.compactThreshold = 0
+				db.maybeCompact()
+				db.mu.Unlock()
+				done := make(chan error, 1)
+				done <- nil
+				return done
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, path := newTestDB(t, 1<<30)
+			tt.setup(t, db)
+
+			var interfered <-chan error
+			testHookFileRead = func(path string) {
+				if interfered == nil {
+					interfered = tt.interfere(t, db, path)
+				}
+			}
+			defer func() { testHookFileRead = func(string) {} }()
+
+			buf := &bytes.Buffer{}
+			err := BackupFile(DriverJSON, path, buf)
+			if err != nil {
+				t.Fatalf("BackupFile: %v", err)
+			}
+			if interfered == nil {
+				t.Fatal("nothing tried to change the files during the backup")
+			}
+			err = <-interfered
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want int
+			db.View(func(dbStructure *DBStructure) error {
+				want = len(dbStructure.Chirps)
+				return nil
+			})
+			if seq := checkBackup(t, buf.Bytes()); seq != want {
+				t.Errorf("backup has %d chirps, want %d", seq, want)
+			}
+
+			// Whatever was held off happens once the backup is done.
+			createChirps(t, db, 1)
+			closeTestDB(t, db)
+			if _, err := os.Stat(db.oldLogPath()); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("the log still awaits compaction: %v", err)
+			}
+			reopened := reopenTestDB(t, db, path)
+			chirps, err := reopened.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != want+1 {
+				t.Errorf("got %d chirps after reopening, want %d", len(chirps), want+1)
+			}
+		})
+	}
+}
+
+// TestInterruptedCompaction simulates crashes at each step of handing
+// the log over to a compaction: after the rotation, and after the new
+// snapshot was committed but before the old log was removed. The next
+// open must replay the old log and finish compacting it.
+func TestInterruptedCompaction(t *testing.T) {
+	tests := []struct {
+		name string
+		// crash leaves behind what a compaction interrupted at some
+		// point would; the log has been rotated before it runs.
+		crash func(t *testing.T, db *DB)
+	}{
+		{
+			name:  "after the rotation",
+			crash: func(t *testing.T, db *DB) {},
+		},
+		{
+			name: "after the snapshot was committed",
+			crash: func(t *testing.T, db *DB) {
+				oldLog, err := os.ReadFile(db.oldLogPath())
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = db.compact(db.generation)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(db.oldLogPath(), oldLog, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, path := newTestDB(t, 1<<30)
+			for i := 0; i < 5; i++ {
+				_, err := db.CreateChirp(fmt.Sprintf("before rotation %d", i), 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.mu.Lock()
+			err := db.rotateLog()
+			db.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				_, err := db.CreateChirp(fmt.Sprintf("after rotation %d", i), 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			tt.crash(t, db)
+
+			db = reopenTestDB(t, db, path)
+			waitForCompaction(t, db)
+			if _, err := os.Stat(db.oldLogPath()); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("old log wasn't compacted on open: %v", err)
+			}
+			snapshot, err := readSnapshot(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(snapshot.collection(collChirps)); n != 5 {
+				t.Errorf("snapshot has %d chirps, want the 5 from the old log", n)
+			}
+
+			chirp, err := db.CreateChirp("after reopening", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.ID != 8 {
+				t.Errorf("new chirp got ID %d, want 8", chirp.ID)
+			}
+			db = reopenTestDB(t, db, path)
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != 8 {
+				t.Errorf("got %d chirps, want 8", len(chirps))
+			}
+		})
+	}
+}
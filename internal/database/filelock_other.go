@@ -0,0 +1,18 @@
+//go:build !unix
+
+package database
+
+import "os"
+
+// Advisory file locks are only implemented on unix. Elsewhere the
+// server and `chirpy backup` don't coordinate, so back up a JSON
+// database with the server stopped or through GET /admin/backup, and
+// nothing stops commands from running while the server is.
+
+func lockFile(f *os.File, exclusive, wait bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
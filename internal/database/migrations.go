@@ -0,0 +1,384 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// migration moves the stored document one schema version up or down.
+// Migrations work on the untyped document, so they keep working
+// however DBStructure changes later on.
+type migration struct {
+	name string
+	up   func(doc document) error
+	down func(doc document) error
+}
+
+// migrations is the ordered registry of schema changes;
+// migrations[i] takes the document from version i to version i+1.
+// Only ever append to it.
+var migrations = []migration{
+	{
+		name: "add_sequences",
+		up:   upAddSequences,
+		down: func(doc document) error {
+			delete(doc, collSequences)
+			return nil
+		},
+	},
+	{
+		// Chirps from before authorship existed belong to user 0.
+		name: "add_chirp_author_id",
+		up: func(doc document) error {
+			return doc.eachRecord(collChirps, func(chirp map[string]any) {
+				if _, ok := chirp["author_id"]; !ok {
+					chirp["author_id"] = 0
+				}
+			})
+		},
+		down: func(doc document) error {
+			return doc.eachRecord(collChirps, func(chirp map[string]any) {
+				delete(chirp, "author_id")
+			})
+		},
+	},
+	{
+		name: "add_refresh_tokens",
+		up: func(doc document) error {
+			doc.collection(collRefreshTokens)
+			return nil
+		},
+		down: func(doc document) error {
+			delete(doc, collRefreshTokens)
+			return nil
+		},
+	},
+	{
+		// Existing users get the default role.
+		name: "add_user_roles",
+		up: func(doc document) error {
+			return doc.eachRecord(collUsers, func(user map[string]any) {
+				if _, ok := user["role"]; !ok {
+					user["role"] = RoleUser
+				}
+			})
+		},
+		down: func(doc document) error {
+			return doc.eachRecord(collUsers, func(user map[string]any) {
+				delete(user, "role")
+			})
+		},
+	},
+	{
+		name: "add_user_tokens",
+		up: func(doc document) error {
+			doc.collection(collUserTokens)
+			return nil
+		},
+		down: func(doc document) error {
+			delete(doc, collUserTokens)
+			return nil
+		},
+	},
+	{
+		// Emails are stored trimmed and lower-cased from now on.
+		// Addresses that would collide with another user's are left
+		// alone; down can't restore the original spelling.
+		name: "add_email_verification",
+		up:   upNormalizeEmails,
+		down: func(doc document) error {
+			return doc.eachRecord(collUsers, func(user map[string]any) {
+				delete(user, "verified_at")
+			})
+		},
+	},
+	{
+		name: "add_totp",
+		up: func(doc document) error {
+			doc.collection(collTOTP)
+			return nil
+		},
+		down: func(doc document) error {
+			delete(doc, collTOTP)
+			return nil
+		},
+	},
+	{
+		name: "add_personal_access_tokens",
+		up: func(doc document) error {
+			doc.collection(collPersonalAccessTokens)
+			return nil
+		},
+		down: func(doc document) error {
+			delete(doc, collPersonalAccessTokens)
+			delete(doc.collection(collSequences), seqPersonalAccessTokens)
+			return nil
+		},
+	},
+	{
+		name: "add_sessions",
+		up:   upAddSessions,
+		down: func(doc document) error {
+			delete(doc, collSessions)
+			return nil
+		},
+	},
+	{
+		name: "add_oauth",
+		up: func(doc document) error {
+			doc.collection(collOAuthClients)
+			doc.collection(collOAuthCodes)
+			return nil
+		},
+		down: func(doc document) error {
+			delete(doc, collOAuthClients)
+			delete(doc, collOAuthCodes)
+			return nil
+		},
+	},
+}
+
+// LatestSchemaVersion is the schema version this build reads and writes.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// MigrationInfo describes one registered migration.
+type MigrationInfo struct {
+	Version int
+	Name    string
+	Applied bool
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of chirpy")
+
+// schemaVersion returns the stored version; files written before
+// versioning have none and count as version 0.
+func (doc document) schemaVersion() (int, error) {
+	v, ok := doc["schema_version"]
+	if !ok {
+		return 0, nil
+	}
+	n, ok := docInt(v)
+	if !ok {
+		return 0, fmt.Errorf("invalid schema_version %v", v)
+	}
+	return n, nil
+}
+
+// migrate runs the migrations needed to bring doc to version target.
+// It reports whether doc changed.
+func (doc document) migrate(target int) (bool, error) {
+	version, err := doc.schemaVersion()
+	if err != nil {
+		return false, err
+	}
+	if version > LatestSchemaVersion() {
+		return false, fmt.Errorf("%w: version %d, supported %d", ErrSchemaTooNew, version, LatestSchemaVersion())
+	}
+	if target < 0 || target > LatestSchemaVersion() {
+		return false, fmt.Errorf("no schema version %d", target)
+	}
+
+	changed := version != target
+	for version < target {
+		m := migrations[version]
+		err = m.up(doc)
+		if err != nil {
+			return false, fmt.Errorf("migration %d (%s) up: %w", version+1, m.name, err)
+		}
+		version++
+		doc["schema_version"] = version
+		log.Printf("database: applied migration %d (%s)", version, m.name)
+	}
+	for version > target {
+		m := migrations[version-1]
+		err = m.down(doc)
+		if err != nil {
+			return false, fmt.Errorf("migration %d (%s) down: %w", version, m.name, err)
+		}
+		version--
+		doc["schema_version"] = version
+		log.Printf("database: reverted migration %d (%s)", version+1, m.name)
+	}
+	return changed, nil
+}
+
+// SchemaStatus reports the schema version of the JSON database at path
+// and every registered migration. The database is not modified.
+func SchemaStatus(path string) (int, []MigrationInfo, error) {
+	doc, err := readDocument(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	version, err := doc.schemaVersion()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	infos := make([]MigrationInfo, 0, len(migrations))
+	for i, m := range migrations {
+		infos = append(infos, MigrationInfo{
+			Version: i + 1,
+			Name:    m.name,
+			Applied: i < version,
+		})
+	}
+	return version, infos, nil
+}
+
+// MigrateTo migrates the JSON database at path to schema version target
+// and folds its log into the snapshot. The server must not be running.
+func MigrateTo(path string, target int) error {
+	doc, err := readDocument(path)
+	if err != nil {
+		return err
+	}
+	_, err = doc.migrate(target)
+	if err != nil {
+		return err
+	}
+
+	dat, err := doc.marshal()
+	if err != nil {
+		return err
+	}
+	return replaceFiles(path, dat)
+}
+
+// collection returns the named collection, creating it if missing.
+func (doc document) collection(name string) map[string]any {
+	c, _ := doc[name].(map[string]any)
+	if c == nil {
+		c = map[string]any{}
+		doc[name] = c
+	}
+	return c
+}
+
+// eachRecord calls fn for every record in the named collection.
+func (doc document) eachRecord(name string, fn func(record map[string]any)) error {
+	for key, value := range doc.collection(name) {
+		record, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: invalid record %q", name, key)
+		}
+		fn(record)
+	}
+	return nil
+}
+
+func docInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := strconv.Atoi(n.String())
+		return i, err == nil
+	case int:
+		return n, true
+	case float64:
+		return int(n), float64(int(n)) == n
+	}
+	return 0, false
+}
+
+// upAddSequences introduces per-collection ID sequences. Databases from
+// before it gave new records len(collection)+1 as their ID, which could
+// collide with existing records, so every record whose ID disagrees with
+// its key is given a fresh ID and each sequence starts past the highest
+// ID in use.
+func upAddSequences(doc document) error {
+	sequences := doc.collection(collSequences)
+
+	for _, name := range []string{collChirps, collUsers} {
+		records := doc.collection(name)
+
+		maxID := 0
+		if n, ok := docInt(sequences[name]); ok {
+			maxID = n
+		}
+		for key := range records {
+			id, err := strconv.Atoi(key)
+			if err != nil {
+				return fmt.Errorf("%s: invalid key %q", name, key)
+			}
+			if id > maxID {
+				maxID = id
+			}
+		}
+
+		for key, value := range records {
+			record, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: invalid record %q", name, key)
+			}
+			id, _ := docInt(record["id"])
+			if strconv.Itoa(id) == key {
+				continue
+			}
+
+			maxID++
+			record["id"] = maxID
+			delete(records, key)
+			records[strconv.Itoa(maxID)] = record
+			log.Printf("database: %s record stored under id %s renumbered to %d", name, key, maxID)
+		}
+
+		sequences[name] = maxID
+	}
+	return nil
+}
+
+// upNormalizeEmails trims and lower-cases user emails.
+func upNormalizeEmails(doc document) error {
+	normalized := func(user map[string]any) string {
+		email, _ := user["email"].(string)
+		return strings.ToLower(strings.TrimSpace(email))
+	}
+
+	counts := map[string]int{}
+	err := doc.eachRecord(collUsers, func(user map[string]any) {
+		counts[normalized(user)]++
+	})
+	if err != nil {
+		return err
+	}
+	return doc.eachRecord(collUsers, func(user map[string]any) {
+		if email := normalized(user); counts[email] == 1 {
+			user["email"] = email
+		}
+	})
+}
+
+// upAddSessions records a session for every refresh token family that
+// is still live. Where they logged in from was never kept.
+func upAddSessions(doc document) error {
+	sessions := doc.collection(collSessions)
+	return doc.eachRecord(collRefreshTokens, func(token map[string]any) {
+		familyID, _ := token["family_id"].(string)
+		userID, _ := docInt(token["user_id"])
+		replacedBy, _ := token["replaced_by"].(string)
+		if familyID == "" || token["revoked_at"] != nil || replacedBy != "" {
+			return
+		}
+
+		// The live token is the newest of its family: it was created
+		// when the session was last used.
+		session := map[string]any{
+			"id":           familyID,
+			"user_id":      userID,
+			"user_agent":   "",
+			"ip":           "",
+			"created_at":   token["created_at"],
+			"last_used_at": token["created_at"],
+			"expires_at":   token["expires_at"],
+		}
+		if root, ok := doc.collection(collRefreshTokens)[familyID].(map[string]any); ok {
+			session["created_at"] = root["created_at"]
+		}
+		sessions[familyID] = session
+	})
+}
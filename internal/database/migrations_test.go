@@ -0,0 +1,108 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// legacyDatabase is a database.json from before sequences, when new
+// records got len(collection)+1 as their ID: chirp 2 was created after
+// a deletion and reused ID 1, and so did user 3 with ID 2.
+const legacyDatabase = `{
+	"chirps": {
+		"1": {"id": 1, "body": "first"},
+		"2": {"id": 1, "body": "reused an ID"},
+		"5": {"id": 5, "body": "after a gap"}
+	},
+	"users": {
+		"1": {"id": 1, "email": "one@example.com", "password": "x"},
+		"3": {"id": 2, "email": "two@example.com", "password": "x"}
+	}
+}`
+
+func TestUpAddSequences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(legacyDatabase), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The renumbered records keep their IDs when the migration is
+	// reverted, so applying it again changes nothing.
+	for _, step := range []struct {
+		name   string
+		target int
+	}{
+		{name: "up", target: 1},
+		{name: "down", target: 0},
+		{name: "up again", target: 1},
+	} {
+		err = MigrateTo(path, step.target)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		doc, err := readSnapshot(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkMigratedIDs(t, step.name, doc, collChirps, []int{1, 5, 6})
+		checkMigratedIDs(t, step.name, doc, collUsers, []int{1, 4})
+
+		sequences, ok := doc[collSequences].(map[string]any)
+		if step.target == 0 {
+			if ok {
+				t.Errorf("%s: sequences weren't removed", step.name)
+			}
+			continue
+		}
+		if !ok {
+			t.Fatalf("%s: no sequences", step.name)
+		}
+		for name, want := range map[string]int{collChirps: 6, collUsers: 4} {
+			if got, _ := docInt(sequences[name]); got != want {
+				t.Errorf("%s: %s sequence is %v, want %d", step.name, name, sequences[name], want)
+			}
+		}
+	}
+
+	err = MigrateTo(path, LatestSchemaVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	chirp, err := db.CreateChirp("new", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.ID != 7 {
+		t.Errorf("new chirp got ID %d, want 7", chirp.ID)
+	}
+}
+
+// checkMigratedIDs checks that collection name holds records with
+// exactly wantIDs, each stored under its own ID.
+func checkMigratedIDs(t *testing.T, step string, doc document, name string, wantIDs []int) {
+	t.Helper()
+	records, _ := doc[name].(map[string]any)
+	ids := []int{}
+	for key, value := range records {
+		record, _ := value.(map[string]any)
+		id, _ := docInt(record["id"])
+		if strconv.Itoa(id) != key {
+			t.Errorf("%s: %s record %v stored under %q", step, name, record["id"], key)
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, wantIDs) {
+		t.Errorf("%s: %s IDs are %v, want %v", step, name, ids, wantIDs)
+	}
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// OAuthClient is a third-party application registered to use Chirpy
+// accounts through OAuth. Confidential clients have a secret; public
+// ones (browser and mobile apps) rely on PKCE alone.
+type OAuthClient struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"secret_hash,omitempty"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Confidential reports whether the client must authenticate with its
+// secret.
+func (c OAuthClient) Confidential() bool {
+	return c.SecretHash != ""
+}
+
+// HasRedirectURI reports whether uri is registered, exactly.
+func (c OAuthClient) HasRedirectURI(uri string) bool {
+	return slices.Contains(c.RedirectURIs, uri)
+}
+
+// OAuthCode is an authorization code waiting to be exchanged for
+// tokens. Only its hash is stored.
+type OAuthCode struct {
+	Hash          string    `json:"hash"`
+	ClientID      string    `json:"client_id"`
+	UserID        int       `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scopes        []string  `json:"scopes"`
+	CodeChallenge string    `json:"code_challenge"`
+	Nonce         string    `json:"nonce,omitempty"`
+	AuthTime      time.Time `json:"auth_time"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+func (db *DB) CreateOAuthClient(client OAuthClient) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.OAuthClients[client.ID]; ok {
+			return ErrAlreadyExists
+		}
+		return put(tx, collOAuthClients, tx.OAuthClients, client.ID, client)
+	})
+}
+
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	client := OAuthClient{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		var ok bool
+		client, ok = dbStructure.OAuthClients[id]
+		if !ok {
+			return ErrNotExist
+		}
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+// GetOAuthClients returns every client, oldest first.
+func (db *DB) GetOAuthClients() ([]OAuthClient, error) {
+	clients := []OAuthClient{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, client := range dbStructure.OAuthClients {
+			clients = append(clients, client)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		if !clients[i].CreatedAt.Equal(clients[j].CreatedAt) {
+			return clients[i].CreatedAt.Before(clients[j].CreatedAt)
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	return clients, nil
+}
+
+// DeleteOAuthClient removes client id and its pending codes.
+func (db *DB) DeleteOAuthClient(id string) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.OAuthClients[id]; !ok {
+			return ErrNotExist
+		}
+		for hash, code := range tx.OAuthCodes {
+			if code.ClientID == id {
+				remove(tx, collOAuthCodes, tx.OAuthCodes, hash)
+			}
+		}
+		remove(tx, collOAuthClients, tx.OAuthClients, id)
+		return nil
+	})
+}
+
+// CreateOAuthCode stores an authorization code. Expired codes are
+// dropped along the way.
+func (db *DB) CreateOAuthCode(code OAuthCode) error {
+	now := time.Now().UTC()
+
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.OAuthClients[code.ClientID]; !ok {
+			return ErrNotExist
+		}
+		for hash, existing := range tx.OAuthCodes {
+			if !now.Before(existing.ExpiresAt) {
+				remove(tx, collOAuthCodes, tx.OAuthCodes, hash)
+			}
+		}
+		return put(tx, collOAuthCodes, tx.OAuthCodes, code.Hash, code)
+	})
+}
+
+// ConsumeOAuthCode deletes the code stored under hash and returns it,
+// so it can only be exchanged once. It fails with ErrTokenExpired if
+// the code has expired.
+func (db *DB) ConsumeOAuthCode(hash string) (OAuthCode, error) {
+	code := OAuthCode{}
+	err := db.Update(func(tx *Tx) error {
+		var ok bool
+		code, ok = tx.OAuthCodes[hash]
+		if !ok {
+			return ErrNotExist
+		}
+		remove(tx, collOAuthCodes, tx.OAuthCodes, hash)
+		return nil
+	})
+	if err != nil {
+		return OAuthCode{}, err
+	}
+	if !time.Now().Before(code.ExpiresAt) {
+		return OAuthCode{}, ErrTokenExpired
+	}
+
+	return code, nil
+}
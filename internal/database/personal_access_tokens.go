@@ -0,0 +1,122 @@
+package database
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// PersonalAccessToken is a long-lived credential a user creates for
+// scripts and bots. Only the hash of the token is stored.
+type PersonalAccessToken struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// HasScope reports whether the token was granted scope.
+func (t PersonalAccessToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// CreatePersonalAccessToken stores token under a new ID. Expired
+// tokens of the same user are dropped along the way.
+func (db *DB) CreatePersonalAccessToken(token PersonalAccessToken) (PersonalAccessToken, error) {
+	now := time.Now().UTC()
+
+	err := db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[token.UserID]; !ok {
+			return ErrNotExist
+		}
+		for id, existing := range tx.PersonalAccessTokens {
+			if existing.UserID == token.UserID && !now.Before(existing.ExpiresAt) {
+				remove(tx, collPersonalAccessTokens, tx.PersonalAccessTokens, id)
+			}
+		}
+
+		id, err := tx.nextID(seqPersonalAccessTokens)
+		if err != nil {
+			return err
+		}
+		token.ID = id
+		return put(tx, collPersonalAccessTokens, tx.PersonalAccessTokens, id, token)
+	})
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+
+	return token, nil
+}
+
+// GetPersonalAccessTokens returns the tokens of user userID, oldest first.
+func (db *DB) GetPersonalAccessTokens(userID int) ([]PersonalAccessToken, error) {
+	tokens := []PersonalAccessToken{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, token := range dbStructure.PersonalAccessTokens {
+			if token.UserID == userID {
+				tokens = append(tokens, token)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID < tokens[j].ID
+	})
+	return tokens, nil
+}
+
+// GetPersonalAccessTokenByHash returns the token stored under hash.
+// It fails with ErrTokenExpired once the token has expired.
+func (db *DB) GetPersonalAccessTokenByHash(hash string) (PersonalAccessToken, error) {
+	token := PersonalAccessToken{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, existing := range dbStructure.PersonalAccessTokens {
+			if existing.Hash == hash {
+				token = existing
+				return nil
+			}
+		}
+		return ErrNotExist
+	})
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	if !time.Now().Before(token.ExpiresAt) {
+		return PersonalAccessToken{}, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+// DeletePersonalAccessToken revokes token id of user userID.
+func (db *DB) DeletePersonalAccessToken(userID, id int) error {
+	return db.Update(func(tx *Tx) error {
+		token, ok := tx.PersonalAccessTokens[id]
+		if !ok || token.UserID != userID {
+			return ErrNotExist
+		}
+		remove(tx, collPersonalAccessTokens, tx.PersonalAccessTokens, id)
+		return nil
+	})
+}
+
+// DeleteUserPersonalAccessTokens revokes every personal access token
+// of user userID.
+func (db *DB) DeleteUserPersonalAccessTokens(userID int) error {
+	return db.Update(func(tx *Tx) error {
+		for id, token := range tx.PersonalAccessTokens {
+			if token.UserID == userID {
+				remove(tx, collPersonalAccessTokens, tx.PersonalAccessTokens, id)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// RefreshToken is the server-side record of an issued refresh token.
+// Every token issued by rotating another belongs to the same family as
+// the token issued at login, so a whole session can be revoked at once.
+type RefreshToken struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"user_id"`
+	FamilyID   string     `json:"family_id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	ReplacedBy string     `json:"replaced_by,omitempty"`
+}
+
+var (
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenRevoked = errors.New("token revoked")
+	// ErrTokenReused is returned when an already rotated refresh token
+	// is presented again. Its whole family has been revoked.
+	ErrTokenReused = errors.New("token reused")
+)
+
+// session fills in the session a login token starts.
+func (token RefreshToken) session(session Session) Session {
+	session.ID = token.FamilyID
+	session.UserID = token.UserID
+	session.CreatedAt = token.CreatedAt
+	session.LastUsedAt = token.CreatedAt
+	session.ExpiresAt = token.ExpiresAt
+	return session
+}
+
+// checkRotation decides whether old may be rotated at now.
+func (old RefreshToken) checkRotation(now time.Time) error {
+	if old.RevokedAt != nil {
+		return ErrTokenRevoked
+	}
+	if old.ReplacedBy != "" {
+		return ErrTokenReused
+	}
+	if !now.Before(old.ExpiresAt) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// CreateRefreshToken stores a token issued at login, which starts a new
+// family and the session it stands for. session only needs its
+// UserAgent and IP set. Expired tokens and sessions of the same user
+// are dropped along the way.
+func (db *DB) CreateRefreshToken(token RefreshToken, session Session) error {
+	token.FamilyID = token.ID
+	session = token.session(session)
+	now := time.Now().UTC()
+
+	return db.Update(func(tx *Tx) error {
+		for id, existing := range tx.RefreshTokens {
+			if existing.UserID == token.UserID && !now.Before(existing.ExpiresAt) {
+				remove(tx, collRefreshTokens, tx.RefreshTokens, id)
+			}
+		}
+		for id, existing := range tx.Sessions {
+			if existing.UserID == token.UserID && !now.Before(existing.ExpiresAt) {
+				remove(tx, collSessions, tx.Sessions, id)
+			}
+		}
+		err := put(tx, collRefreshTokens, tx.RefreshTokens, token.ID, token)
+		if err != nil {
+			return err
+		}
+		return put(tx, collSessions, tx.Sessions, session.ID, session)
+	})
+}
+
+// RotateRefreshToken replaces the token oldID with next, which joins the
+// same family and user. The session is marked as used from ip and
+// userAgent. Presenting a token that was already rotated means it has
+// leaked, so the whole family is revoked and ErrTokenReused returned.
+func (db *DB) RotateRefreshToken(oldID string, next RefreshToken, ip, userAgent string) (RefreshToken, error) {
+	now := time.Now().UTC()
+
+	reused := false
+	err := db.Update(func(tx *Tx) error {
+		old, ok := tx.RefreshTokens[oldID]
+		if !ok {
+			return ErrNotExist
+		}
+
+		err := old.checkRotation(now)
+		if errors.Is(err, ErrTokenReused) {
+			reused = true
+			return revokeFamily(tx, old.FamilyID, now)
+		}
+		if err != nil {
+			return err
+		}
+		session, ok := tx.Sessions[old.FamilyID]
+		if !ok {
+			return ErrTokenRevoked
+		}
+
+		next.UserID = old.UserID
+		next.FamilyID = old.FamilyID
+		old.ReplacedBy = next.ID
+		err = put(tx, collRefreshTokens, tx.RefreshTokens, old.ID, old)
+		if err != nil {
+			return err
+		}
+		err = put(tx, collRefreshTokens, tx.RefreshTokens, next.ID, next)
+		if err != nil {
+			return err
+		}
+
+		session.IP = ip
+		session.UserAgent = userAgent
+		session.LastUsedAt = next.CreatedAt
+		session.ExpiresAt = next.ExpiresAt
+		return put(tx, collSessions, tx.Sessions, session.ID, session)
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if reused {
+		return RefreshToken{}, ErrTokenReused
+	}
+
+	return next, nil
+}
+
+// RevokeRefreshToken revokes the token id and every other token in its family.
+func (db *DB) RevokeRefreshToken(id string) error {
+	now := time.Now().UTC()
+
+	return db.Update(func(tx *Tx) error {
+		token, ok := tx.RefreshTokens[id]
+		if !ok {
+			return ErrNotExist
+		}
+		return revokeFamily(tx, token.FamilyID, now)
+	})
+}
+
+// RevokeUserRefreshTokens revokes every session of user userID but
+// the one with family ID except, if given.
+func (db *DB) RevokeUserRefreshTokens(userID int, except string) error {
+	now := time.Now().UTC()
+
+	return db.Update(func(tx *Tx) error {
+		for id, session := range tx.Sessions {
+			if session.UserID == userID && id != except {
+				remove(tx, collSessions, tx.Sessions, id)
+			}
+		}
+		for id, token := range tx.RefreshTokens {
+			if token.UserID != userID || token.RevokedAt != nil || token.FamilyID == except {
+				continue
+			}
+			token.RevokedAt = &now
+			err := put(tx, collRefreshTokens, tx.RefreshTokens, id, token)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// revokeFamily revokes every token of a family and ends its session.
+func revokeFamily(tx *Tx, familyID string, now time.Time) error {
+	remove(tx, collSessions, tx.Sessions, familyID)
+	for id, token := range tx.RefreshTokens {
+		if token.FamilyID != familyID || token.RevokedAt != nil {
+			continue
+		}
+		token.RevokedAt = &now
+		err := put(tx, collRefreshTokens, tx.RefreshTokens, id, token)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
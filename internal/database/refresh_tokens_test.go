@@ -0,0 +1,193 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testRefreshToken returns a token for user 1 that expires in expiresIn.
+func testRefreshToken(id string, expiresIn time.Duration) RefreshToken {
+	now := time.Now().UTC()
+	return RefreshToken{
+		ID:        id,
+		UserID:    1,
+		CreatedAt: now,
+		ExpiresAt: now.Add(expiresIn),
+	}
+}
+
+// getTestRefreshToken reads the stored record of token id, which
+// Store has no method for.
+func getTestRefreshToken(t *testing.T, store Store, id string) RefreshToken {
+	t.Helper()
+	var token RefreshToken
+	var err error
+	switch s := store.(type) {
+	case *DB:
+		err = s.View(func(dbStructure *DBStructure) error {
+			var ok bool
+			token, ok = dbStructure.RefreshTokens[id]
+			if !ok {
+				return ErrNotExist
+			}
+			return nil
+		})
+	case *SQLiteDB:
+		tx, txErr := s.db.Begin()
+		if txErr != nil {
+			t.Fatal(txErr)
+		}
+		defer tx.Rollback()
+		token, err = getRefreshToken(tx, id)
+	default:
+		t.Fatalf("unknown store %T", store)
+	}
+	if err != nil {
+		t.Fatalf("refresh token %s: %v", id, err)
+	}
+	return token
+}
+
+// createTestSession logs user 1 in with the token "login".
+func createTestSession(t *testing.T, store Store, expiresIn time.Duration) {
+	t.Helper()
+	err := store.CreateRefreshToken(testRefreshToken("login", expiresIn), Session{IP: "192.0.2.1", UserAgent: "login"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		createTestSession(t, store, time.Hour)
+
+		next, err := store.RotateRefreshToken("login", testRefreshToken("second", 2*time.Hour), "192.0.2.2", "rotated")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.UserID != 1 || next.FamilyID != "login" {
+			t.Errorf("rotated token = %+v, want user 1 in family login", next)
+		}
+		if old := getTestRefreshToken(t, store, "login"); old.ReplacedBy != "second" || old.RevokedAt != nil {
+			t.Errorf("old token = %+v, want replaced by second and not revoked", old)
+		}
+
+		session, err := store.GetSession("login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session.IP != "192.0.2.2" || session.UserAgent != "rotated" || !session.ExpiresAt.Equal(next.ExpiresAt) {
+			t.Errorf("session = %+v, want it moved to the rotated token", session)
+		}
+
+		_, err = store.RotateRefreshToken("second", testRefreshToken("third", time.Hour), "192.0.2.2", "rotated")
+		if err != nil {
+			t.Errorf("rotating the new token: %v", err)
+		}
+		_, err = store.RotateRefreshToken("unknown", testRefreshToken("fourth", time.Hour), "", "")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("rotating an unknown token: got %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		createTestSession(t, store, time.Hour)
+		_, err := store.RotateRefreshToken("login", testRefreshToken("second", time.Hour), "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.RotateRefreshToken("login", testRefreshToken("stolen", time.Hour), "", "")
+		if !errors.Is(err, ErrTokenReused) {
+			t.Fatalf("presenting a rotated token: got %v, want ErrTokenReused", err)
+		}
+
+		for _, id := range []string{"login", "second"} {
+			if token := getTestRefreshToken(t, store, id); token.RevokedAt == nil {
+				t.Errorf("token %s not revoked", id)
+			}
+		}
+		_, err = store.GetSession("login")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("session after reuse: got %v, want ErrNotExist", err)
+		}
+		_, err = store.RotateRefreshToken("second", testRefreshToken("third", time.Hour), "", "")
+		if !errors.Is(err, ErrTokenRevoked) {
+			t.Errorf("rotating the latest token after reuse: got %v, want ErrTokenRevoked", err)
+		}
+		_, err = store.RotateRefreshToken("stolen", testRefreshToken("fourth", time.Hour), "", "")
+		if !errors.Is(err, ErrNotExist) {
+			t.Errorf("token issued for the reuse: got %v, want ErrNotExist", err)
+		}
+	})
+}
+
+func TestRevokeRefreshTokenEndsSession(t *testing.T) {
+	tests := []struct {
+		name   string
+		revoke func(store Store) error
+	}{
+		{
+			name:   "revoke first token",
+			revoke: func(store Store) error { return store.RevokeRefreshToken("login") },
+		},
+		{
+			name:   "revoke latest token",
+			revoke: func(store Store) error { return store.RevokeRefreshToken("second") },
+		},
+		{
+			name:   "revoke session",
+			revoke: func(store Store) error { return store.RevokeSession(1, "login") },
+		},
+		{
+			name:   "revoke all sessions",
+			revoke: func(store Store) error { return store.RevokeUserRefreshTokens(1, "") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store Store) {
+				createTestSession(t, store, time.Hour)
+				_, err := store.RotateRefreshToken("login", testRefreshToken("second", time.Hour), "", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				err = tt.revoke(store)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = store.GetSession("login")
+				if !errors.Is(err, ErrNotExist) {
+					t.Errorf("session after revoking: got %v, want ErrNotExist", err)
+				}
+				_, err = store.RotateRefreshToken("second", testRefreshToken("third", time.Hour), "", "")
+				if !errors.Is(err, ErrTokenRevoked) {
+					t.Errorf("rotating after revoking: got %v, want ErrTokenRevoked", err)
+				}
+			})
+		})
+	}
+}
+
+func TestRefreshTokenExpired(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		createTestSession(t, store, -time.Minute)
+
+		_, err := store.RotateRefreshToken("login", testRefreshToken("second", time.Hour), "", "")
+		if !errors.Is(err, ErrTokenExpired) {
+			t.Errorf("rotating an expired token: got %v, want ErrTokenExpired", err)
+		}
+		_, err = store.GetSession("login")
+		if !errors.Is(err, ErrTokenExpired) {
+			t.Errorf("expired session: got %v, want ErrTokenExpired", err)
+		}
+		if token := getTestRefreshToken(t, store, "login"); token.ReplacedBy != "" {
+			t.Errorf("expired token was rotated: %+v", token)
+		}
+	})
+}
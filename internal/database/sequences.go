@@ -0,0 +1,20 @@
+package database
+
+// Names of the ID sequences kept in DBStructure.Sequences.
+const (
+	seqChirps = collChirps
+	seqUsers  = collUsers
+
+	seqPersonalAccessTokens = collPersonalAccessTokens
+)
+
+// nextID returns the next ID of the named sequence and advances it.
+// IDs are never reused, even after the newest record is deleted.
+func (tx *Tx) nextID(name string) (int, error) {
+	id := tx.Sequences[name] + 1
+	err := put(tx, collSequences, tx.Sequences, name, id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// Session is a login on one device: the refresh token issued at login
+// and every token rotated from it. Its ID is the family ID of those
+// tokens. IP and UserAgent are from the last time it was used.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	// ExpiresAt is when the session's current refresh token expires.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// GetSession returns the live session id. Ended sessions are gone;
+// expired ones fail with ErrTokenExpired.
+func (db *DB) GetSession(id string) (Session, error) {
+	session := Session{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		var ok bool
+		session, ok = dbStructure.Sessions[id]
+		if !ok {
+			return ErrNotExist
+		}
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if !time.Now().Before(session.ExpiresAt) {
+		return Session{}, ErrTokenExpired
+	}
+
+	return session, nil
+}
+
+// GetUserSessions returns the live sessions of user userID, most
+// recently used first.
+func (db *DB) GetUserSessions(userID int) ([]Session, error) {
+	now := time.Now()
+	sessions := []Session{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, session := range dbStructure.Sessions {
+			if session.UserID == userID && now.Before(session.ExpiresAt) {
+				sessions = append(sessions, session)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// RevokeSession ends session id of user userID.
+func (db *DB) RevokeSession(userID int, id string) error {
+	now := time.Now().UTC()
+
+	return db.Update(func(tx *Tx) error {
+		session, ok := tx.Sessions[id]
+		if !ok || session.UserID != userID {
+			return ErrNotExist
+		}
+		return revokeFamily(tx, id, now)
+	})
+}
+
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+}
@@ -0,0 +1,389 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteDB stores chirps and users in an SQLite database.
+// It uses the pure-Go modernc.org/sqlite driver, so no cgo is needed.
+type SQLiteDB struct {
+	path string
+	db   *sql.DB
+}
+
+// sqliteMigrations are applied in order on open.
+// The number of applied migrations is kept in PRAGMA user_version,
+// so new schema changes must be appended, never edited.
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		id INTEGER PRIMARY KEY,
+		email TEXT NOT NULL,
+		hashed_password TEXT NOT NULL
+	);
+	CREATE UNIQUE INDEX users_email_idx ON users (email);
+	CREATE TABLE chirps (
+		id INTEGER PRIMARY KEY,
+		body TEXT NOT NULL
+	);`,
+	// AUTOINCREMENT keeps IDs monotonic: without it SQLite
+	// reuses the highest ID once that row is deleted.
+	`CREATE TABLE users_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL,
+		hashed_password TEXT NOT NULL
+	);
+	INSERT INTO users_new (id, email, hashed_password)
+		SELECT id, email, hashed_password FROM users;
+	DROP TABLE users;
+	ALTER TABLE users_new RENAME TO users;
+	CREATE UNIQUE INDEX users_email_idx ON users (email);
+	CREATE TABLE chirps_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		body TEXT NOT NULL
+	);
+	INSERT INTO chirps_new (id, body) SELECT id, body FROM chirps;
+	DROP TABLE chirps;
+	ALTER TABLE chirps_new RENAME TO chirps;`,
+	// Chirps from before authorship existed belong to user 0.
+	`ALTER TABLE chirps ADD COLUMN author_id INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX chirps_author_id_idx ON chirps (author_id);`,
+	`CREATE TABLE refresh_tokens (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		family_id TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		revoked_at DATETIME,
+		replaced_by TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+	CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);`,
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+	`CREATE TABLE user_tokens (
+		hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		purpose TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX user_tokens_user_id_idx ON user_tokens (user_id);`,
+	// Emails are stored trimmed and lower-cased from now on. Addresses
+	// that would collide with another user's are left alone.
+	`ALTER TABLE users ADD COLUMN verified_at DATETIME;
+	ALTER TABLE user_tokens ADD COLUMN email TEXT NOT NULL DEFAULT '';
+	UPDATE users SET email = lower(trim(email))
+		WHERE email != lower(trim(email)) AND NOT EXISTS (
+			SELECT 1 FROM users AS other
+			WHERE other.id != users.id AND lower(trim(other.email)) = lower(trim(users.email))
+		);`,
+	`CREATE TABLE totp (
+		user_id INTEGER PRIMARY KEY,
+		secret TEXT NOT NULL,
+		confirmed_at DATETIME,
+		last_step INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE recovery_codes (
+		hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL
+	);
+	CREATE INDEX recovery_codes_user_id_idx ON recovery_codes (user_id);`,
+	`CREATE TABLE personal_access_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE UNIQUE INDEX personal_access_tokens_hash_idx ON personal_access_tokens (hash);
+	CREATE INDEX personal_access_tokens_user_id_idx ON personal_access_tokens (user_id);`,
+	// Live refresh token families become sessions; where they
+	// logged in from was never kept.
+	`CREATE TABLE sessions (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+	INSERT INTO sessions (id, user_id, created_at, last_used_at, expires_at)
+		SELECT live.family_id, live.user_id, root.created_at, live.created_at, live.expires_at
+		FROM refresh_tokens AS live JOIN refresh_tokens AS root ON root.id = live.family_id
+		WHERE live.revoked_at IS NULL AND live.replaced_by = '';`,
+	`CREATE TABLE oauth_clients (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		secret_hash TEXT NOT NULL DEFAULT '',
+		redirect_uris TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE oauth_codes (
+		hash TEXT PRIMARY KEY,
+		client_id TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		redirect_uri TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		code_challenge TEXT NOT NULL,
+		nonce TEXT NOT NULL DEFAULT '',
+		auth_time DATETIME NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE INDEX oauth_codes_client_id_idx ON oauth_codes (client_id);
+	CREATE INDEX oauth_codes_user_id_idx ON oauth_codes (user_id);`,
+}
+
+// NewSQLiteDB opens the SQLite database at path,
+// creating it and its schema if needed.
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serialising connections
+	// avoids SQLITE_BUSY errors between our own goroutines.
+	db.SetMaxOpenConns(1)
+
+	sdb := &SQLiteDB{
+		path: path,
+		db:   db,
+	}
+	err = sdb.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sdb, nil
+}
+
+func (s *SQLiteDB) migrate() error {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	err = checkSQLiteSchemaVersion(version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sqliteMigrations[i])
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying database handle.
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteDB) ResetDB() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"oauth_codes", "oauth_clients", "sessions", "personal_access_tokens", "recovery_codes", "totp", "user_tokens", "refresh_tokens", "chirps", "users"} {
+		_, err = tx.Exec("DELETE FROM " + table)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// Backup writes a consistent copy of the database file to w.
+// VACUUM INTO takes a read transaction, so writers keep going.
+func (s *SQLiteDB) Backup(w io.Writer) error {
+	dir, err := os.MkdirTemp(filepath.Dir(s.path), ".chirpy-backup-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "backup.db")
+	_, err = s.db.Exec("VACUUM INTO ?", tmpPath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Restore replaces the database with a backup written by Backup.
+// The backup is copied in with SQLite's online backup API over the
+// store's own connection, so requests running meanwhile wait for it
+// and then see either the old or the restored data.
+func (s *SQLiteDB) Restore(r io.Reader) error {
+	tmpPath, err := writeSQLiteBackup(s.path, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	conn, err := s.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	err = conn.Raw(func(driverConn any) error {
+		restorer, ok := driverConn.(interface {
+			NewRestore(srcURI string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return errors.New("sqlite driver can't restore backups")
+		}
+		restore, err := restorer.NewRestore("file:" + tmpPath + "?mode=ro")
+		if err != nil {
+			return err
+		}
+		_, err = restore.Step(-1)
+		if finishErr := restore.Finish(); err == nil {
+			err = finishErr
+		}
+		return err
+	})
+	// The pool has a single connection, which migrate needs.
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// The backup may be from before later migrations.
+	return s.migrate()
+}
+
+// writeSQLiteBackup copies a backup from r to a temporary file next to
+// path and checks it. The caller removes the file.
+func writeSQLiteBackup(path string, r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = checkSQLiteFile(tmpPath)
+		if err != nil {
+			err = fmt.Errorf("invalid backup: %w", err)
+		}
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// restoreSQLiteFile replaces the SQLite database at path with a backup
+// without opening the current file. The backup is migrated when the
+// database is next opened.
+func restoreSQLiteFile(path string, r io.Reader) error {
+	tmpPath, err := writeSQLiteBackup(path, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	for _, suffix := range []string{"-wal", "-shm"} {
+		err = os.Remove(path + suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// checkSQLiteSchemaVersion refuses databases migrated by a newer
+// version of chirpy, whose schema this one doesn't know.
+func checkSQLiteSchemaVersion(version int) error {
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("%w: version %d, supported %d", ErrSchemaTooNew, version, len(sqliteMigrations))
+	}
+	return nil
+}
+
+// checkSQLiteFile verifies that path holds an intact SQLite database
+// with a schema this version of chirpy knows.
+func checkSQLiteFile(path string) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	result := ""
+	err = db.QueryRow("PRAGMA quick_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return errors.New(result)
+	}
+
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	return checkSQLiteSchemaVersion(version)
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+func (s *SQLiteDB) CreateChirp(body string, authorID int) (Chirp, error) {
+	res, err := s.db.Exec("INSERT INTO chirps (body, author_id) VALUES (?, ?)", body, authorID)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return Chirp{
+		ID:       int(id),
+		AuthorID: authorID,
+		Body:     body,
+	}, nil
+}
+
+func (s *SQLiteDB) GetChirps() ([]Chirp, error) {
+	rows, err := s.db.Query("SELECT id, author_id, body FROM chirps ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp := Chirp{}
+		err = rows.Scan(&chirp.ID, &chirp.AuthorID, &chirp.Body)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, rows.Err()
+}
+
+func (s *SQLiteDB) GetChirp(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := s.db.QueryRow("SELECT id, author_id, body FROM chirps WHERE id = ?", id).Scan(&chirp.ID, &chirp.AuthorID, &chirp.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotExist
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (s *SQLiteDB) DeleteChirp(id int) error {
+	_, err := s.db.Exec("DELETE FROM chirps WHERE id = ?", id)
+	return err
+}
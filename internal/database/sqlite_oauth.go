@@ -0,0 +1,136 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Redirect URIs and scopes are stored space-separated; neither can
+// contain spaces.
+
+const sqliteOAuthClientColumns = "id, name, secret_hash, redirect_uris, created_at"
+
+func (s *SQLiteDB) CreateOAuthClient(client OAuthClient) error {
+	_, err := s.db.Exec(`INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, created_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		client.ID, client.Name, client.SecretHash, strings.Join(client.RedirectURIs, " "), client.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *SQLiteDB) GetOAuthClient(id string) (OAuthClient, error) {
+	client, err := scanOAuthClient(s.db.QueryRow("SELECT "+sqliteOAuthClientColumns+" FROM oauth_clients WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return OAuthClient{}, ErrNotExist
+	}
+	return client, err
+}
+
+func (s *SQLiteDB) GetOAuthClients() ([]OAuthClient, error) {
+	rows, err := s.db.Query("SELECT " + sqliteOAuthClientColumns + " FROM oauth_clients ORDER BY created_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteOAuthClient(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM oauth_clients WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotExist
+	}
+	_, err = tx.Exec("DELETE FROM oauth_codes WHERE client_id = ?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) CreateOAuthCode(code OAuthCode) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM oauth_clients WHERE id = ?)", code.ClientID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotExist
+	}
+
+	_, err = tx.Exec("DELETE FROM oauth_codes WHERE expires_at <= ?", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, scopes, code_challenge, nonce, auth_time, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		code.Hash, code.ClientID, code.UserID, code.RedirectURI, strings.Join(code.Scopes, " "),
+		code.CodeChallenge, code.Nonce, code.AuthTime, code.CreatedAt, code.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) ConsumeOAuthCode(hash string) (OAuthCode, error) {
+	code := OAuthCode{}
+	var scopes string
+	err := s.db.QueryRow(`DELETE FROM oauth_codes WHERE hash = ?
+		RETURNING hash, client_id, user_id, redirect_uri, scopes, code_challenge, nonce, auth_time, created_at, expires_at`, hash).
+		Scan(&code.Hash, &code.ClientID, &code.UserID, &code.RedirectURI, &scopes,
+			&code.CodeChallenge, &code.Nonce, &code.AuthTime, &code.CreatedAt, &code.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OAuthCode{}, ErrNotExist
+	}
+	if err != nil {
+		return OAuthCode{}, err
+	}
+	if !time.Now().UTC().Before(code.ExpiresAt) {
+		return OAuthCode{}, ErrTokenExpired
+	}
+	code.Scopes = strings.Fields(scopes)
+
+	return code, nil
+}
+
+func scanOAuthClient(row rowScanner) (OAuthClient, error) {
+	client := OAuthClient{}
+	var redirectURIs string
+	err := row.Scan(&client.ID, &client.Name, &client.SecretHash, &redirectURIs, &client.CreatedAt)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	return client, nil
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Scopes are stored space-separated, as in OAuth.
+
+func (s *SQLiteDB) CreatePersonalAccessToken(token PersonalAccessToken) (PersonalAccessToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", token.UserID).Scan(&exists)
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	if !exists {
+		return PersonalAccessToken{}, ErrNotExist
+	}
+
+	_, err = tx.Exec("DELETE FROM personal_access_tokens WHERE user_id = ? AND expires_at <= ?", token.UserID, time.Now().UTC())
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	res, err := tx.Exec(`INSERT INTO personal_access_tokens (user_id, name, hash, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		token.UserID, token.Name, token.Hash, strings.Join(token.Scopes, " "), token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	token.ID = int(id)
+
+	return token, tx.Commit()
+}
+
+const sqlitePersonalAccessTokenColumns = "id, user_id, name, hash, scopes, created_at, expires_at"
+
+func (s *SQLiteDB) GetPersonalAccessTokens(userID int) ([]PersonalAccessToken, error) {
+	rows, err := s.db.Query("SELECT "+sqlitePersonalAccessTokenColumns+" FROM personal_access_tokens WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []PersonalAccessToken{}
+	for rows.Next() {
+		token, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SQLiteDB) GetPersonalAccessTokenByHash(hash string) (PersonalAccessToken, error) {
+	token, err := scanPersonalAccessToken(s.db.QueryRow("SELECT "+sqlitePersonalAccessTokenColumns+" FROM personal_access_tokens WHERE hash = ?", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return PersonalAccessToken{}, ErrNotExist
+	}
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	if !time.Now().UTC().Before(token.ExpiresAt) {
+		return PersonalAccessToken{}, ErrTokenExpired
+	}
+
+	return token, nil
+}
+
+func (s *SQLiteDB) DeletePersonalAccessToken(userID, id int) error {
+	res, err := s.db.Exec("DELETE FROM personal_access_tokens WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotExist
+	}
+	return nil
+}
+
+func (s *SQLiteDB) DeleteUserPersonalAccessTokens(userID int) error {
+	_, err := s.db.Exec("DELETE FROM personal_access_tokens WHERE user_id = ?", userID)
+	return err
+}
+
+func scanPersonalAccessToken(row rowScanner) (PersonalAccessToken, error) {
+	token := PersonalAccessToken{}
+	var scopes string
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.Hash, &scopes, &token.CreatedAt, &token.ExpiresAt)
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	return token, nil
+}
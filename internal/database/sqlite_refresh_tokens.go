@@ -0,0 +1,167 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (s *SQLiteDB) CreateRefreshToken(token RefreshToken, session Session) error {
+	token.FamilyID = token.ID
+	session = token.session(session)
+	now := time.Now().UTC()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM refresh_tokens WHERE user_id = ? AND expires_at <= ?", token.UserID, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ? AND expires_at <= ?", token.UserID, now)
+	if err != nil {
+		return err
+	}
+	err = insertRefreshToken(tx, token)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO sessions (id, user_id, user_agent, ip, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, session.UserAgent, session.IP, session.CreatedAt, session.LastUsedAt, session.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) RotateRefreshToken(oldID string, next RefreshToken, ip, userAgent string) (RefreshToken, error) {
+	now := time.Now().UTC()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := getRefreshToken(tx, oldID)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	err = old.checkRotation(now)
+	if errors.Is(err, ErrTokenReused) {
+		err = revokeSQLiteFamily(tx, old.FamilyID, now)
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{}, ErrTokenReused
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	next.UserID = old.UserID
+	next.FamilyID = old.FamilyID
+	res, err := tx.Exec("UPDATE sessions SET ip = ?, user_agent = ?, last_used_at = ?, expires_at = ? WHERE id = ?",
+		ip, userAgent, next.CreatedAt, next.ExpiresAt, next.FamilyID)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if n == 0 {
+		return RefreshToken{}, ErrTokenRevoked
+	}
+	_, err = tx.Exec("UPDATE refresh_tokens SET replaced_by = ? WHERE id = ?", next.ID, old.ID)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	err = insertRefreshToken(tx, next)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	return next, tx.Commit()
+}
+
+func (s *SQLiteDB) RevokeRefreshToken(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	token, err := getRefreshToken(tx, id)
+	if err != nil {
+		return err
+	}
+	err = revokeSQLiteFamily(tx, token.FamilyID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) RevokeUserRefreshTokens(userID int, except string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userID, except)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL AND family_id != ?",
+		time.Now().UTC(), userID, except)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertRefreshToken(tx *sql.Tx, token RefreshToken) error {
+	_, err := tx.Exec(`INSERT INTO refresh_tokens (id, user_id, family_id, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		token.ID, token.UserID, token.FamilyID, token.CreatedAt, token.ExpiresAt)
+	return err
+}
+
+func getRefreshToken(tx *sql.Tx, id string) (RefreshToken, error) {
+	token := RefreshToken{}
+	revokedAt := sql.NullTime{}
+	err := tx.QueryRow(`SELECT id, user_id, family_id, created_at, expires_at, revoked_at, replaced_by
+		FROM refresh_tokens WHERE id = ?`, id).
+		Scan(&token.ID, &token.UserID, &token.FamilyID, &token.CreatedAt, &token.ExpiresAt, &revokedAt, &token.ReplacedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RefreshToken{}, ErrNotExist
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+	return token, nil
+}
+
+// revokeSQLiteFamily revokes every token of a family and ends its session.
+func revokeSQLiteFamily(tx *sql.Tx, familyID string, now time.Time) error {
+	_, err := tx.Exec("DELETE FROM sessions WHERE id = ?", familyID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL", now, familyID)
+	return err
+}
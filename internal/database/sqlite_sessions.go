@@ -0,0 +1,77 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const sqliteSessionColumns = "id, user_id, user_agent, ip, created_at, last_used_at, expires_at"
+
+func (s *SQLiteDB) GetSession(id string) (Session, error) {
+	session, err := scanSession(s.db.QueryRow("SELECT "+sqliteSessionColumns+" FROM sessions WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrNotExist
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if !time.Now().UTC().Before(session.ExpiresAt) {
+		return Session{}, ErrTokenExpired
+	}
+
+	return session, nil
+}
+
+func (s *SQLiteDB) GetUserSessions(userID int) ([]Session, error) {
+	rows, err := s.db.Query("SELECT "+sqliteSessionColumns+" FROM sessions WHERE user_id = ? AND expires_at > ?",
+		userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (s *SQLiteDB) RevokeSession(userID int, id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM sessions WHERE id = ? AND user_id = ?)", id, userID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotExist
+	}
+	err = revokeSQLiteFamily(tx, id, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func scanSession(row rowScanner) (Session, error) {
+	session := Session{}
+	err := row.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+	return session, err
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestSQLiteRestoreWhileInUse restores a backup while other goroutines
+// keep using the store.
+func TestSQLiteRestoreWhileInUse(t *testing.T) {
+	db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := db.CreateChirp(fmt.Sprintf("backed up %d", i), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	backup := &bytes.Buffer{}
+	err = db.Backup(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, err := db.CreateChirp(fmt.Sprintf("lost %d", i), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				chirps, err := db.GetChirps()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(chirps) != 3 && len(chirps) != 6 {
+					t.Errorf("read %d chirps during the restore, want 3 or 6", len(chirps))
+					return
+				}
+			}
+		}()
+	}
+	err = db.Restore(backup)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 3 {
+		t.Errorf("got %d chirps after restoring, want 3", len(chirps))
+	}
+	chirp, err := db.CreateChirp("after restore", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.ID != 4 {
+		t.Errorf("new chirp got ID %d, want 4", chirp.ID)
+	}
+}
+
+func TestSQLiteSchemaTooNew(t *testing.T) {
+	dir := t.TempDir()
+	newerPath := filepath.Join(dir, "newer.db")
+	newer, err := NewSQLiteDB(newerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newer.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(sqliteMigrations)+1))
+	if err == nil {
+		err = newer.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewSQLiteDB(newerPath)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("opening a newer database: got %v, want ErrSchemaTooNew", err)
+	}
+
+	db, err := NewSQLiteDB(filepath.Join(dir, "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.CreateChirp("kept", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := os.Open(newerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	err = db.Restore(backup)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("restoring a newer backup: got %v, want ErrSchemaTooNew", err)
+	}
+	if _, err := db.GetChirp(1); err != nil {
+		t.Errorf("database changed by a rejected restore: %v", err)
+	}
+}
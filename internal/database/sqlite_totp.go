@@ -0,0 +1,127 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+func (s *SQLiteDB) GetTOTP(userID int) (TOTP, error) {
+	totp := TOTP{}
+	confirmedAt := sql.NullTime{}
+	err := s.db.QueryRow("SELECT user_id, secret, confirmed_at, last_step FROM totp WHERE user_id = ?", userID).
+		Scan(&totp.UserID, &totp.Secret, &confirmedAt, &totp.LastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTP{}, ErrNotExist
+	}
+	if err != nil {
+		return TOTP{}, err
+	}
+	if confirmedAt.Valid {
+		totp.ConfirmedAt = &confirmedAt.Time
+	}
+
+	rows, err := s.db.Query("SELECT hash FROM recovery_codes WHERE user_id = ? ORDER BY hash", userID)
+	if err != nil {
+		return TOTP{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return TOTP{}, err
+		}
+		totp.RecoveryCodes = append(totp.RecoveryCodes, hash)
+	}
+
+	return totp, rows.Err()
+}
+
+func (s *SQLiteDB) SaveTOTP(totp TOTP) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", totp.UserID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotExist
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO totp (user_id, secret, confirmed_at, last_step)
+		VALUES (?, ?, ?, ?)`,
+		totp.UserID, totp.Secret, totp.ConfirmedAt, totp.LastStep)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", totp.UserID)
+	if err != nil {
+		return err
+	}
+	for _, hash := range totp.RecoveryCodes {
+		_, err = tx.Exec("INSERT INTO recovery_codes (hash, user_id) VALUES (?, ?)", hash, totp.UserID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) DeleteTOTP(userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM totp WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) UseTOTPStep(userID int, step int64) error {
+	res, err := s.db.Exec("UPDATE totp SET last_step = ? WHERE user_id = ? AND last_step < ?", step, userID, step)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		_, err = s.GetTOTP(userID)
+		if err != nil {
+			return err
+		}
+		return ErrTokenReused
+	}
+	return nil
+}
+
+func (s *SQLiteDB) UseRecoveryCode(userID int, hash string) error {
+	res, err := s.db.Exec("DELETE FROM recovery_codes WHERE hash = ? AND user_id = ?", hash, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotExist
+	}
+	return nil
+}
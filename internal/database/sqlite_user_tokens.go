@@ -0,0 +1,46 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (s *SQLiteDB) CreateUserToken(token UserToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM user_tokens WHERE (user_id = ? AND purpose = ?) OR expires_at <= ?",
+		token.UserID, token.Purpose, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO user_tokens (hash, user_id, purpose, email, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		token.Hash, token.UserID, token.Purpose, token.Email, token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) ConsumeUserToken(hash, purpose string) (UserToken, error) {
+	token := UserToken{}
+	err := s.db.QueryRow(`DELETE FROM user_tokens WHERE hash = ? AND purpose = ?
+		RETURNING hash, user_id, purpose, email, created_at, expires_at`, hash, purpose).
+		Scan(&token.Hash, &token.UserID, &token.Purpose, &token.Email, &token.CreatedAt, &token.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserToken{}, ErrNotExist
+	}
+	if err != nil {
+		return UserToken{}, err
+	}
+	if !time.Now().UTC().Before(token.ExpiresAt) {
+		return UserToken{}, ErrTokenExpired
+	}
+
+	return token, nil
+}
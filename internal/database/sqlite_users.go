@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const sqliteUserColumns = "id, email, hashed_password, role, verified_at"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	user := User{}
+	verifiedAt := sql.NullTime{}
+	err := row.Scan(&user.ID, &user.Email, &user.HashedPassword, &user.Role, &verifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotExist
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if verifiedAt.Valid {
+		user.VerifiedAt = &verifiedAt.Time
+	}
+	return user, nil
+}
+
+func (s *SQLiteDB) CreateUser(email, hashedPassword string) (User, error) {
+	res, err := s.db.Exec("INSERT INTO users (email, hashed_password, role) VALUES (?, ?, ?)", email, hashedPassword, RoleUser)
+	if isUniqueViolation(err) {
+		return User{}, ErrAlreadyExists
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	return User{
+		ID:             int(id),
+		Email:          email,
+		HashedPassword: hashedPassword,
+		Role:           RoleUser,
+	}, nil
+}
+
+func (s *SQLiteDB) GetUser(id int) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE id = ?", id))
+}
+
+func (s *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE email = ?", email))
+}
+
+func (s *SQLiteDB) UpdateUser(id int, email, hashedPassword string) (User, error) {
+	// SET expressions see the old row, so verified_at is cleared
+	// only when the email really changes.
+	res, err := s.db.Exec(`UPDATE users SET
+		verified_at = CASE WHEN email = ? THEN verified_at ELSE NULL END,
+		email = ?, hashed_password = ?
+		WHERE id = ?`, email, email, hashedPassword, id)
+	if isUniqueViolation(err) {
+		return User{}, ErrAlreadyExists
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return User{}, err
+	}
+	if n == 0 {
+		return User{}, ErrNotExist
+	}
+
+	return s.GetUser(id)
+}
+
+func (s *SQLiteDB) DeleteUser(id int, keepChirps bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotExist
+	}
+
+	statements := []string{
+		"DELETE FROM chirps WHERE author_id = ?",
+		"DELETE FROM refresh_tokens WHERE user_id = ?",
+		"DELETE FROM user_tokens WHERE user_id = ?",
+		"DELETE FROM totp WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM personal_access_tokens WHERE user_id = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM oauth_codes WHERE user_id = ?",
+	}
+	if keepChirps {
+		statements[0] = "UPDATE chirps SET author_id = 0 WHERE author_id = ?"
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) SetUserRole(id int, role string) (User, error) {
+	if !ValidRole(role) {
+		return User{}, ErrInvalidRole
+	}
+
+	res, err := s.db.Exec("UPDATE users SET role = ? WHERE id = ?", role, id)
+	if err != nil {
+		return User{}, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return User{}, err
+	}
+	if n == 0 {
+		return User{}, ErrNotExist
+	}
+
+	return s.GetUser(id)
+}
+
+func (s *SQLiteDB) VerifyUser(id int) (User, error) {
+	res, err := s.db.Exec("UPDATE users SET verified_at = COALESCE(verified_at, ?) WHERE id = ?", time.Now().UTC(), id)
+	if err != nil {
+		return User{}, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return User{}, err
+	}
+	if n == 0 {
+		return User{}, ErrNotExist
+	}
+
+	return s.GetUser(id)
+}
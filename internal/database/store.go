@@ -0,0 +1,130 @@
+package database
+
+import (
+	"fmt"
+	"io"
+)
+
+// Store is the storage interface the handlers depend on.
+// DB (the database.json file) and SQLiteDB both implement it.
+type Store interface {
+	CreateChirp(body string, authorID int) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	GetChirp(id int) (Chirp, error)
+	DeleteChirp(id int) error
+
+	CreateUser(email, hashedPassword string) (User, error)
+	GetUser(id int) (User, error)
+	GetUserByEmail(email string) (User, error)
+	UpdateUser(id int, email, hashedPassword string) (User, error)
+	SetUserRole(id int, role string) (User, error)
+	VerifyUser(id int) (User, error)
+	DeleteUser(id int, keepChirps bool) error
+
+	CreateRefreshToken(token RefreshToken, session Session) error
+	RotateRefreshToken(oldID string, next RefreshToken, ip, userAgent string) (RefreshToken, error)
+	RevokeRefreshToken(id string) error
+	RevokeUserRefreshTokens(userID int, except string) error
+
+	GetSession(id string) (Session, error)
+	GetUserSessions(userID int) ([]Session, error)
+	RevokeSession(userID int, id string) error
+
+	CreateUserToken(token UserToken) error
+	ConsumeUserToken(hash, purpose string) (UserToken, error)
+
+	GetTOTP(userID int) (TOTP, error)
+	SaveTOTP(totp TOTP) error
+	DeleteTOTP(userID int) error
+	UseTOTPStep(userID int, step int64) error
+	UseRecoveryCode(userID int, hash string) error
+
+	CreatePersonalAccessToken(token PersonalAccessToken) (PersonalAccessToken, error)
+	GetPersonalAccessTokens(userID int) ([]PersonalAccessToken, error)
+	GetPersonalAccessTokenByHash(hash string) (PersonalAccessToken, error)
+	DeletePersonalAccessToken(userID, id int) error
+	DeleteUserPersonalAccessTokens(userID int) error
+
+	CreateOAuthClient(client OAuthClient) error
+	GetOAuthClient(id string) (OAuthClient, error)
+	GetOAuthClients() ([]OAuthClient, error)
+	DeleteOAuthClient(id string) error
+	CreateOAuthCode(code OAuthCode) error
+	ConsumeOAuthCode(hash string) (OAuthCode, error)
+
+	ResetDB() error
+	// Backup writes a consistent copy of the whole database to w
+	// while the store stays in use.
+	Backup(w io.Writer) error
+	// Restore replaces the whole database with a copy written by Backup.
+	Restore(r io.Reader) error
+	// Close releases the store's files. The store can't be used after.
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
+
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+// Open opens the store for the given driver.
+// An empty driver selects the JSON file store.
+func Open(driver, path string) (Store, error) {
+	switch driver {
+	case "", DriverJSON:
+		return NewDB(path)
+	case DriverSQLite:
+		return NewSQLiteDB(path)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
+
+// RestoreFile replaces the database at path with a backup written by
+// Backup or BackupFile. The current files are replaced without being
+// opened, so a database that is damaged or from a newer version of
+// chirpy can be restored too. The server must be stopped first.
+func RestoreFile(driver, path string, r io.Reader) error {
+	switch driver {
+	case "", DriverJSON:
+		return restoreJSONFile(path, r)
+	case DriverSQLite:
+		return restoreSQLiteFile(path, r)
+	default:
+		return fmt.Errorf("unknown database driver %q", driver)
+	}
+}
+
+// BackupFile writes a copy of the database at path to w. The JSON files
+// are only read, under a shared lock the server respects when it
+// rotates or compacts the log, so this is safe to run while a server
+// is using the database.
+func BackupFile(driver, path string, w io.Writer) error {
+	switch driver {
+	case "", DriverJSON:
+		doc, err := readDocumentLocked(path)
+		if err != nil {
+			return err
+		}
+		dat, err := doc.marshal()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(dat)
+		return err
+	case DriverSQLite:
+		db, err := NewSQLiteDB(path)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.Backup(w)
+	default:
+		return fmt.Errorf("unknown database driver %q", driver)
+	}
+}
@@ -0,0 +1,331 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestStoreContract checks that both stores behave the same wherever
+// handlers depend on it. Each case gets a fresh store of each driver.
+func TestStoreContract(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store Store)
+	}{
+		{name: "duplicate email", test: testStoreDuplicateEmail},
+		{name: "IDs not reused", test: testStoreIDsNotReused},
+		{name: "not exist", test: testStoreNotExist},
+		{name: "user tokens are single-use", test: testStoreConsumeUserToken},
+		{name: "delete user", test: testStoreDeleteUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, tt.test)
+		})
+	}
+}
+
+// createTestUser creates a user with email or fails the test.
+func createTestUser(t *testing.T, store Store, email string) User {
+	t.Helper()
+	user, err := store.CreateUser(email, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func testStoreDuplicateEmail(t *testing.T, store Store) {
+	createTestUser(t, store, "a@example.com")
+	b := createTestUser(t, store, "b@example.com")
+
+	_, err := store.CreateUser("a@example.com", "other")
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("creating a duplicate: got %v, want ErrAlreadyExists", err)
+	}
+	_, err = store.UpdateUser(b.ID, "a@example.com", "hash")
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("updating to a taken email: got %v, want ErrAlreadyExists", err)
+	}
+	_, err = store.UpdateUser(b.ID, "b@example.com", "new hash")
+	if err != nil {
+		t.Errorf("updating without changing the email: %v", err)
+	}
+}
+
+func testStoreIDsNotReused(t *testing.T, store Store) {
+	createTestUser(t, store, "a@example.com")
+	b := createTestUser(t, store, "b@example.com")
+	err := store.DeleteUser(b.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := createTestUser(t, store, "c@example.com")
+	if c.ID <= b.ID {
+		t.Errorf("user created after deleting %d got ID %d", b.ID, c.ID)
+	}
+
+	createTestChirp := func() Chirp {
+		chirp, err := store.CreateChirp("chirp", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chirp
+	}
+	createTestChirp()
+	last := createTestChirp()
+	err = store.DeleteChirp(last.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := createTestChirp(); next.ID <= last.ID {
+		t.Errorf("chirp created after deleting %d got ID %d", last.ID, next.ID)
+	}
+
+	createTestPAT := func() PersonalAccessToken {
+		token, err := store.CreatePersonalAccessToken(PersonalAccessToken{
+			UserID:    1,
+			Name:      "bot",
+			Hash:      time.Now().String(),
+			CreatedAt: time.Now().UTC(),
+			ExpiresAt: time.Now().UTC().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	pat := createTestPAT()
+	err = store.DeletePersonalAccessToken(1, pat.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := createTestPAT(); next.ID <= pat.ID {
+		t.Errorf("token created after deleting %d got ID %d", pat.ID, next.ID)
+	}
+}
+
+func testStoreNotExist(t *testing.T, store Store) {
+	createTestUser(t, store, "a@example.com")
+	err := store.SaveTOTP(TOTP{UserID: 1, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{name: "GetUser", call: func() error { _, err := store.GetUser(99); return err }},
+		{name: "GetUserByEmail", call: func() error { _, err := store.GetUserByEmail("nobody@example.com"); return err }},
+		{name: "UpdateUser", call: func() error { _, err := store.UpdateUser(99, "b@example.com", "hash"); return err }},
+		{name: "SetUserRole", call: func() error { _, err := store.SetUserRole(99, RoleAdmin); return err }},
+		{name: "VerifyUser", call: func() error { _, err := store.VerifyUser(99); return err }},
+		{name: "DeleteUser", call: func() error { return store.DeleteUser(99, false) }},
+		{name: "GetChirp", call: func() error { _, err := store.GetChirp(99); return err }},
+		{name: "RotateRefreshToken", call: func() error {
+			_, err := store.RotateRefreshToken("missing", testRefreshToken("next", time.Hour), "", "")
+			return err
+		}},
+		{name: "RevokeRefreshToken", call: func() error { return store.RevokeRefreshToken("missing") }},
+		{name: "GetSession", call: func() error { _, err := store.GetSession("missing"); return err }},
+		{name: "RevokeSession", call: func() error { return store.RevokeSession(1, "missing") }},
+		{name: "ConsumeUserToken", call: func() error {
+			_, err := store.ConsumeUserToken("missing", TokenPurposePasswordReset)
+			return err
+		}},
+		{name: "GetTOTP", call: func() error { _, err := store.GetTOTP(99); return err }},
+		{name: "SaveTOTP", call: func() error { return store.SaveTOTP(TOTP{UserID: 99}) }},
+		{name: "UseTOTPStep", call: func() error { return store.UseTOTPStep(99, 1) }},
+		{name: "UseRecoveryCode without TOTP", call: func() error { return store.UseRecoveryCode(99, "code") }},
+		{name: "UseRecoveryCode unknown code", call: func() error { return store.UseRecoveryCode(1, "code") }},
+		{name: "CreatePersonalAccessToken", call: func() error {
+			_, err := store.CreatePersonalAccessToken(PersonalAccessToken{UserID: 99, Hash: "hash"})
+			return err
+		}},
+		{name: "GetPersonalAccessTokenByHash", call: func() error {
+			_, err := store.GetPersonalAccessTokenByHash("missing")
+			return err
+		}},
+		{name: "DeletePersonalAccessToken", call: func() error { return store.DeletePersonalAccessToken(1, 99) }},
+		{name: "GetOAuthClient", call: func() error { _, err := store.GetOAuthClient("missing"); return err }},
+		{name: "DeleteOAuthClient", call: func() error { return store.DeleteOAuthClient("missing") }},
+		{name: "CreateOAuthCode", call: func() error {
+			return store.CreateOAuthCode(OAuthCode{Hash: "hash", ClientID: "missing", UserID: 1})
+		}},
+		{name: "ConsumeOAuthCode", call: func() error { _, err := store.ConsumeOAuthCode("missing"); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if !errors.Is(err, ErrNotExist) {
+				t.Errorf("got %v, want ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func testStoreConsumeUserToken(t *testing.T, store Store) {
+	user := createTestUser(t, store, "a@example.com")
+	now := time.Now().UTC()
+	create := func(hash string, expiresIn time.Duration) {
+		t.Helper()
+		err := store.CreateUserToken(UserToken{
+			Hash:      hash,
+			UserID:    user.ID,
+			Purpose:   TokenPurposePasswordReset,
+			CreatedAt: now,
+			ExpiresAt: now.Add(expiresIn),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	create("reset", time.Hour)
+	_, err := store.ConsumeUserToken("reset", TokenPurposeMagicLogin)
+	if !errors.Is(err, ErrNotExist) {
+		t.Errorf("consuming for another purpose: got %v, want ErrNotExist", err)
+	}
+	token, err := store.ConsumeUserToken("reset", TokenPurposePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.UserID != user.ID {
+		t.Errorf("token user = %d, want %d", token.UserID, user.ID)
+	}
+	_, err = store.ConsumeUserToken("reset", TokenPurposePasswordReset)
+	if !errors.Is(err, ErrNotExist) {
+		t.Errorf("consuming twice: got %v, want ErrNotExist", err)
+	}
+
+	// A new token of the same purpose replaces the old one.
+	create("first", time.Hour)
+	create("second", time.Hour)
+	_, err = store.ConsumeUserToken("first", TokenPurposePasswordReset)
+	if !errors.Is(err, ErrNotExist) {
+		t.Errorf("consuming a superseded token: got %v, want ErrNotExist", err)
+	}
+
+	create("expired", -time.Minute)
+	_, err = store.ConsumeUserToken("expired", TokenPurposePasswordReset)
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("consuming an expired token: got %v, want ErrTokenExpired", err)
+	}
+	_, err = store.ConsumeUserToken("expired", TokenPurposePasswordReset)
+	if !errors.Is(err, ErrNotExist) {
+		t.Errorf("consuming an expired token twice: got %v, want ErrNotExist", err)
+	}
+}
+
+func testStoreDeleteUser(t *testing.T, store Store) {
+	for _, keepChirps := range []bool{false, true} {
+		err := store.ResetDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted := createTestUser(t, store, "deleted@example.com")
+		kept := createTestUser(t, store, "kept@example.com")
+		now := time.Now().UTC()
+
+		var deletedChirp, keptChirp Chirp
+		var keptPAT PersonalAccessToken
+		for _, user := range []User{deleted, kept} {
+			chirp, err := store.CreateChirp("chirp", user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id := user.Email
+			err = store.CreateRefreshToken(RefreshToken{ID: id, UserID: user.ID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}, Session{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CreateUserToken(UserToken{Hash: id, UserID: user.ID, Purpose: TokenPurposePasswordReset, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.SaveTOTP(TOTP{UserID: user.ID, Secret: "secret", RecoveryCodes: []string{id}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pat, err := store.CreatePersonalAccessToken(PersonalAccessToken{UserID: user.ID, Name: "bot", Hash: id, CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.ID == deleted.ID {
+				deletedChirp = chirp
+			} else {
+				keptChirp, keptPAT = chirp, pat
+			}
+		}
+		err = store.CreateOAuthClient(OAuthClient{ID: "client", Name: "app", RedirectURIs: []string{"https://example.com/cb"}, CreatedAt: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.CreateOAuthCode(OAuthCode{Hash: "code", ClientID: "client", UserID: deleted.ID, CreatedAt: now, ExpiresAt: now.Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.DeleteUser(deleted.ID, keepChirps)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := deleted.Email
+		gone := []struct {
+			name string
+			call func() error
+		}{
+			{name: "user", call: func() error { _, err := store.GetUser(deleted.ID); return err }},
+			{name: "user by email", call: func() error { _, err := store.GetUserByEmail(d); return err }},
+			{name: "session", call: func() error { _, err := store.GetSession(d); return err }},
+			{name: "refresh token", call: func() error {
+				_, err := store.RotateRefreshToken(d, testRefreshToken("next", time.Hour), "", "")
+				return err
+			}},
+			{name: "user token", call: func() error {
+				_, err := store.ConsumeUserToken(d, TokenPurposePasswordReset)
+				return err
+			}},
+			{name: "TOTP", call: func() error { _, err := store.GetTOTP(deleted.ID); return err }},
+			{name: "personal access token", call: func() error { _, err := store.GetPersonalAccessTokenByHash(d); return err }},
+			{name: "OAuth code", call: func() error { _, err := store.ConsumeOAuthCode("code"); return err }},
+		}
+		for _, g := range gone {
+			if err := g.call(); !errors.Is(err, ErrNotExist) {
+				t.Errorf("keepChirps=%v: deleted user's %s: got %v, want ErrNotExist", keepChirps, g.name, err)
+			}
+		}
+
+		chirp, err := store.GetChirp(deletedChirp.ID)
+		switch {
+		case keepChirps && err != nil:
+			t.Errorf("kept chirp: %v", err)
+		case keepChirps && chirp.AuthorID != 0:
+			t.Errorf("kept chirp author = %d, want 0", chirp.AuthorID)
+		case !keepChirps && !errors.Is(err, ErrNotExist):
+			t.Errorf("deleted user's chirp: got %v, want ErrNotExist", err)
+		}
+
+		if _, err := store.GetUser(kept.ID); err != nil {
+			t.Errorf("other user: %v", err)
+		}
+		if chirp, err := store.GetChirp(keptChirp.ID); err != nil || chirp.AuthorID != kept.ID {
+			t.Errorf("other user's chirp = %+v, %v", chirp, err)
+		}
+		if _, err := store.GetSession(kept.Email); err != nil {
+			t.Errorf("other user's session: %v", err)
+		}
+		if _, err := store.GetTOTP(kept.ID); err != nil {
+			t.Errorf("other user's TOTP: %v", err)
+		}
+		if pat, err := store.GetPersonalAccessTokenByHash(kept.Email); err != nil || pat.ID != keptPAT.ID {
+			t.Errorf("other user's personal access token = %+v, %v", pat, err)
+		}
+		if _, err := store.ConsumeUserToken(kept.Email, TokenPurposePasswordReset); err != nil {
+			t.Errorf("other user's user token: %v", err)
+		}
+	}
+}
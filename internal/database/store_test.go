@@ -0,0 +1,191 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// forEachStore runs test against a fresh store of every driver.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Helper()
+	drivers := []struct {
+		driver string
+		file   string
+	}{
+		{driver: DriverJSON, file: "database.json"},
+		{driver: DriverSQLite, file: "database.db"},
+	}
+	for _, d := range drivers {
+		t.Run(d.driver, func(t *testing.T) {
+			store, err := Open(d.driver, filepath.Join(t.TempDir(), d.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				err := store.Close()
+				if err != nil {
+					t.Error(err)
+				}
+			})
+			test(t, store)
+		})
+	}
+}
+
+// TestRestoreFileOverBrokenDatabase restores over a database that can't
+// be opened, as after a bad deploy.
+func TestRestoreFileOverBrokenDatabase(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver string
+		file   string
+		// current is what the database files hold before restoring.
+		current map[string]string
+	}{
+		{
+			name:    "json: corrupt snapshot",
+			driver:  DriverJSON,
+			file:    "database.json",
+			current: map[string]string{"": "{garbage", ".log": "[{garbage\n"},
+		},
+		{
+			name:    "json: newer schema",
+			driver:  DriverJSON,
+			file:    "database.json",
+			current: map[string]string{"": `{"schema_version": 99}`, ".log.old": "[]\n"},
+		},
+		{
+			name:    "sqlite: corrupt file",
+			driver:  DriverSQLite,
+			file:    "database.db",
+			current: map[string]string{"": "garbage", "-wal": "garbage"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, tt.file)
+			db, err := Open(tt.driver, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				_, err := db.CreateChirp("backed up", 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			backup := &bytes.Buffer{}
+			err = db.Backup(backup)
+			if err == nil {
+				err = db.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for suffix, dat := range tt.current {
+				err := os.WriteFile(path+suffix, []byte(dat), 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = Open(tt.driver, path)
+			if err == nil {
+				t.Fatal("opened the broken database")
+			}
+
+			err = RestoreFile(tt.driver, path, backup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for suffix := range tt.current {
+				if suffix == "" {
+					continue
+				}
+				if _, err := os.Stat(path + suffix); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("%s wasn't removed: %v", path+suffix, err)
+				}
+			}
+
+			db, err = Open(tt.driver, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != 3 {
+				t.Errorf("got %d chirps after restoring, want 3", len(chirps))
+			}
+		})
+	}
+}
+
+func TestRestoreFileRejectsInvalidBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("kept", 1)
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RestoreFile(DriverJSON, path, bytes.NewBufferString("{garbage"))
+	if err == nil {
+		t.Fatal("restored an invalid backup")
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.GetChirp(1); err != nil {
+		t.Errorf("database changed by a failed restore: %v", err)
+	}
+}
+
+// TestDatabaseInUse checks that a JSON database open in one place, as
+// in a running server, can't be written from another.
+func TestDatabaseInUse(t *testing.T) {
+	db, path := newTestDB(t, defaultCompactThreshold)
+	_, err := db.CreateChirp("server", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDB(path)
+	if !errors.Is(err, ErrDatabaseInUse) {
+		t.Errorf("opening again: got %v, want ErrDatabaseInUse", err)
+	}
+	err = RestoreFile(DriverJSON, path, bytes.NewBufferString(`{"schema_version": 1}`))
+	if !errors.Is(err, ErrDatabaseInUse) {
+		t.Errorf("restoring: got %v, want ErrDatabaseInUse", err)
+	}
+	err = MigrateTo(path, LatestSchemaVersion())
+	if !errors.Is(err, ErrDatabaseInUse) {
+		t.Errorf("migrating: got %v, want ErrDatabaseInUse", err)
+	}
+	backup := &bytes.Buffer{}
+	err = BackupFile(DriverJSON, path, backup)
+	if err != nil {
+		t.Errorf("backing up: %v", err)
+	}
+
+	db = reopenTestDB(t, db, path)
+	if _, err := db.GetChirp(1); err != nil {
+		t.Errorf("chirp lost: %v", err)
+	}
+}
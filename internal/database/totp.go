@@ -0,0 +1,91 @@
+package database
+
+import (
+	"slices"
+	"time"
+)
+
+// TOTP is a user's two-factor authentication enrollment. It only
+// takes effect once confirmed with a first code.
+type TOTP struct {
+	UserID      int        `json:"user_id"`
+	Secret      string     `json:"secret"`
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	// LastStep is the time step of the last accepted code,
+	// so a code can't be used twice.
+	LastStep int64 `json:"last_step"`
+	// RecoveryCodes are hashes of the unused recovery codes.
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Enabled reports whether the enrollment was confirmed.
+func (t TOTP) Enabled() bool {
+	return t.ConfirmedAt != nil
+}
+
+func (db *DB) GetTOTP(userID int) (TOTP, error) {
+	totp := TOTP{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		var ok bool
+		totp, ok = dbStructure.TOTP[userID]
+		if !ok {
+			return ErrNotExist
+		}
+		return nil
+	})
+	if err != nil {
+		return TOTP{}, err
+	}
+
+	return totp, nil
+}
+
+// SaveTOTP creates or replaces the enrollment of totp.UserID.
+func (db *DB) SaveTOTP(totp TOTP) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[totp.UserID]; !ok {
+			return ErrNotExist
+		}
+		return put(tx, collTOTP, tx.TOTP, totp.UserID, totp)
+	})
+}
+
+func (db *DB) DeleteTOTP(userID int) error {
+	return db.Update(func(tx *Tx) error {
+		remove(tx, collTOTP, tx.TOTP, userID)
+		return nil
+	})
+}
+
+// UseTOTPStep records that a code from time step step was accepted.
+// It fails with ErrTokenReused unless step is later than the last one.
+func (db *DB) UseTOTPStep(userID int, step int64) error {
+	return db.Update(func(tx *Tx) error {
+		totp, ok := tx.TOTP[userID]
+		if !ok {
+			return ErrNotExist
+		}
+		if step <= totp.LastStep {
+			return ErrTokenReused
+		}
+		totp.LastStep = step
+		return put(tx, collTOTP, tx.TOTP, userID, totp)
+	})
+}
+
+// UseRecoveryCode removes the recovery code with hash, failing with
+// ErrNotExist if the user has no such unused code.
+func (db *DB) UseRecoveryCode(userID int, hash string) error {
+	return db.Update(func(tx *Tx) error {
+		totp, ok := tx.TOTP[userID]
+		if !ok {
+			return ErrNotExist
+		}
+		i := slices.Index(totp.RecoveryCodes, hash)
+		if i < 0 {
+			return ErrNotExist
+		}
+		totp.RecoveryCodes = slices.Delete(slices.Clone(totp.RecoveryCodes), i, i+1)
+		return put(tx, collTOTP, tx.TOTP, userID, totp)
+	})
+}
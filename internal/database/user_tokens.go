@@ -0,0 +1,66 @@
+package database
+
+import "time"
+
+// Purposes of single-use user tokens.
+const (
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposeMagicLogin        = "magic_login"
+)
+
+// UserToken is a single-use token mailed to a user, such as a password
+// reset link. Only a hash of the token is stored, so a leaked database
+// can't be used to take over accounts.
+type UserToken struct {
+	Hash    string `json:"hash"`
+	UserID  int    `json:"user_id"`
+	Purpose string `json:"purpose"`
+	// Email is the address the token was sent to,
+	// for tokens that prove ownership of it.
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateUserToken stores token. Earlier tokens of the same user and
+// purpose stop working, and expired tokens are dropped.
+func (db *DB) CreateUserToken(token UserToken) error {
+	now := time.Now().UTC()
+
+	return db.Update(func(tx *Tx) error {
+		for hash, existing := range tx.UserTokens {
+			superseded := existing.UserID == token.UserID && existing.Purpose == token.Purpose
+			if superseded || !now.Before(existing.ExpiresAt) {
+				remove(tx, collUserTokens, tx.UserTokens, hash)
+			}
+		}
+		return put(tx, collUserTokens, tx.UserTokens, token.Hash, token)
+	})
+}
+
+// ConsumeUserToken deletes the token with hash and returns it. It fails
+// with ErrNotExist unless the token exists and was issued for purpose,
+// and with ErrTokenExpired once it has expired.
+func (db *DB) ConsumeUserToken(hash, purpose string) (UserToken, error) {
+	now := time.Now().UTC()
+
+	token := UserToken{}
+	err := db.Update(func(tx *Tx) error {
+		var ok bool
+		token, ok = tx.UserTokens[hash]
+		if !ok || token.Purpose != purpose {
+			return ErrNotExist
+		}
+		remove(tx, collUserTokens, tx.UserTokens, hash)
+		return nil
+	})
+	if err != nil {
+		return UserToken{}, err
+	}
+	if !now.Before(token.ExpiresAt) {
+		return UserToken{}, ErrTokenExpired
+	}
+
+	return token, nil
+}
@@ -1,6 +1,25 @@
 package database
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
+
+// Roles a user can hold. Every user starts out as RoleUser.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleUser, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
 
 // 5. Storage / 7. Users
 // For now, a user will just have an id (integer) and an email (string).
@@ -8,36 +27,42 @@ type User struct {
 	ID             int    `json:"id"`
 	Email          string `json:"email"`
 	HashedPassword string `json:"hashed_password"`
+	Role           string `json:"role"`
+	// VerifiedAt is when the user proved they own Email;
+	// nil until then, and reset whenever Email changes.
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
 	// IsChirpyRed    bool   `json:"is_chirpy_red"`
 }
 
 var ErrAlreadyExists = errors.New("already exists")
 
+var ErrInvalidRole = errors.New("invalid role")
+
 // 5. Storage / 7. Users
 // func (db *DB) CreateUser(email string) (User, error) {
 // 6. Authentication / 1. Authentication with Passwords
 func (db *DB) CreateUser(email, hashedPassword string) (User, error) {
-	_, err := db.GetUserByEmail(email)
-
-	if !errors.Is(err, ErrNotExist) {
-		return User{}, ErrAlreadyExists
-	}
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	id := len(dbStructure.Users) + 1
-	user := User{
-		ID:             id,
-		Email:          email,
-		HashedPassword: hashedPassword,
-		// IsChirpyRed:    false,
-	}
-	dbStructure.Users[id] = user
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		for _, existing := range tx.Users {
+			if existing.Email == email {
+				return ErrAlreadyExists
+			}
+		}
 
-	err = db.writeDB(dbStructure)
+		id, err := tx.nextID(seqUsers)
+		if err != nil {
+			return err
+		}
+		user = User{
+			ID:             id,
+			Email:          email,
+			HashedPassword: hashedPassword,
+			Role:           RoleUser,
+			// IsChirpyRed:    false,
+		}
+		return put(tx, collUsers, tx.Users, id, user)
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -46,55 +71,167 @@ func (db *DB) CreateUser(email, hashedPassword string) (User, error) {
 }
 
 func (db *DB) GetUser(id int) (User, error) {
-	dbStructure, err := db.loadDB()
+	user := User{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			return ErrNotExist
+		}
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	user, ok := dbStructure.Users[id]
-	if !ok {
-		return User{}, ErrNotExist
-	}
-
 	return user, nil
 }
 
 // 6. Authentication / 1. Authentication with Passwords
 // you don't have access to an ID here
 func (db *DB) GetUserByEmail(email string) (User, error) {
-
-	dbStructure, err := db.loadDB()
+	user := User{}
+	err := db.View(func(dbStructure *DBStructure) error {
+		for _, u := range dbStructure.Users {
+			if u.Email == email {
+				user = u
+				return nil
+			}
+		}
+		return ErrNotExist
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			return user, nil
-		}
-	}
-
-	return User{}, ErrNotExist
+	return user, nil
 }
 
 // 6. Authentication / 6. Authentication with JWTs
 // You'll probably need to add a new UpdateUser method to your database package
 func (db *DB) UpdateUser(id int, email, hashedPassword string) (User, error) {
-	dbStructure, err := db.loadDB()
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		var ok bool
+		user, ok = tx.Users[id]
+		if !ok {
+			return ErrNotExist
+		}
+
+		if user.Email != email {
+			for _, existing := range tx.Users {
+				if existing.Email == email {
+					return ErrAlreadyExists
+				}
+			}
+			user.VerifiedAt = nil
+		}
+		user.Email = email
+		user.HashedPassword = hashedPassword
+		return put(tx, collUsers, tx.Users, id, user)
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	user, ok := dbStructure.Users[id]
-	if !ok {
-		return User{}, ErrNotExist
+	return user, nil
+}
+
+// DeleteUser removes user id together with their sessions, tokens and
+// two-factor settings. Their chirps are deleted too, unless keepChirps
+// is set; then they are kept without an author (author 0).
+func (db *DB) DeleteUser(id int, keepChirps bool) error {
+	return db.Update(func(tx *Tx) error {
+		if _, ok := tx.Users[id]; !ok {
+			return ErrNotExist
+		}
+
+		for chirpID, chirp := range tx.Chirps {
+			if chirp.AuthorID != id {
+				continue
+			}
+			if !keepChirps {
+				remove(tx, collChirps, tx.Chirps, chirpID)
+				continue
+			}
+			chirp.AuthorID = 0
+			err := put(tx, collChirps, tx.Chirps, chirpID, chirp)
+			if err != nil {
+				return err
+			}
+		}
+		for tokenID, token := range tx.RefreshTokens {
+			if token.UserID == id {
+				remove(tx, collRefreshTokens, tx.RefreshTokens, tokenID)
+			}
+		}
+		for hash, token := range tx.UserTokens {
+			if token.UserID == id {
+				remove(tx, collUserTokens, tx.UserTokens, hash)
+			}
+		}
+		for hash, code := range tx.OAuthCodes {
+			if code.UserID == id {
+				remove(tx, collOAuthCodes, tx.OAuthCodes, hash)
+			}
+		}
+		for sessionID, session := range tx.Sessions {
+			if session.UserID == id {
+				remove(tx, collSessions, tx.Sessions, sessionID)
+			}
+		}
+		for tokenID, token := range tx.PersonalAccessTokens {
+			if token.UserID == id {
+				remove(tx, collPersonalAccessTokens, tx.PersonalAccessTokens, tokenID)
+			}
+		}
+		remove(tx, collTOTP, tx.TOTP, id)
+		remove(tx, collUsers, tx.Users, id)
+		return nil
+	})
+}
+
+// SetUserRole changes the role of user id.
+func (db *DB) SetUserRole(id int, role string) (User, error) {
+	if !ValidRole(role) {
+		return User{}, ErrInvalidRole
+	}
+
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		var ok bool
+		user, ok = tx.Users[id]
+		if !ok {
+			return ErrNotExist
+		}
+
+		user.Role = role
+		return put(tx, collUsers, tx.Users, id, user)
+	})
+	if err != nil {
+		return User{}, err
 	}
 
-	user.Email = email
-	user.HashedPassword = hashedPassword
-	dbStructure.Users[id] = user
+	return user, nil
+}
+
+// VerifyUser marks the email address of user id as verified.
+func (db *DB) VerifyUser(id int) (User, error) {
+	now := time.Now().UTC()
 
-	err = db.writeDB(dbStructure)
+	user := User{}
+	err := db.Update(func(tx *Tx) error {
+		var ok bool
+		user, ok = tx.Users[id]
+		if !ok {
+			return ErrNotExist
+		}
+
+		if user.VerifiedAt == nil {
+			user.VerifiedAt = &now
+		}
+		return put(tx, collUsers, tx.Users, id, user)
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -0,0 +1,290 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// logRecord is one mutation in the log. Values are stored whole,
+// so replaying a record twice gives the same result as replaying it once.
+type logRecord struct {
+	Op         string          `json:"op"`
+	Collection string          `json:"collection"`
+	Key        string          `json:"key"`
+	Value      json.RawMessage `json:"value,omitempty"`
+}
+
+// Tx is the view of the database passed to Update.
+// Reads go through the embedded DBStructure; writes must go through
+// put and remove so they are recorded in the log and can be undone.
+type Tx struct {
+	*DBStructure
+	records []logRecord
+	undo    []func()
+}
+
+// rollback reverts the changes made through tx, newest first.
+func (tx *Tx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.records = nil
+	tx.undo = nil
+}
+
+// put sets m[key] = value and records the change in tx.
+func put[K comparable, V any](tx *Tx, collection string, m map[K]V, key K, value V) error {
+	dat, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	old, existed := m[key]
+	m[key] = value
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			m[key] = old
+		} else {
+			delete(m, key)
+		}
+	})
+	tx.records = append(tx.records, logRecord{
+		Op:         opPut,
+		Collection: collection,
+		Key:        fmt.Sprint(key),
+		Value:      dat,
+	})
+	return nil
+}
+
+// remove deletes m[key] and records the change in tx.
+func remove[K comparable, V any](tx *Tx, collection string, m map[K]V, key K) {
+	old, ok := m[key]
+	if !ok {
+		return
+	}
+	delete(m, key)
+	tx.undo = append(tx.undo, func() { m[key] = old })
+	tx.records = append(tx.records, logRecord{
+		Op:         opDelete,
+		Collection: collection,
+		Key:        fmt.Sprint(key),
+	})
+}
+
+// document is the untyped form of the snapshot. Logs are replayed
+// on it rather than on DBStructure, so records written by an
+// older version of DBStructure still apply.
+type document map[string]any
+
+func newDocument(dbStructure DBStructure) (document, error) {
+	dat, err := json.Marshal(dbStructure)
+	if err != nil {
+		return nil, err
+	}
+	return parseDocument(dat)
+}
+
+func parseDocument(dat []byte) (document, error) {
+	doc := document{}
+	decoder := json.NewDecoder(bytes.NewReader(dat))
+	decoder.UseNumber()
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func readSnapshot(path string) (document, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDocument(dat)
+}
+
+func (doc document) marshal() ([]byte, error) {
+	return json.Marshal(doc)
+}
+
+func (doc document) decode() (DBStructure, error) {
+	dbStructure := DBStructure{}
+	dat, err := doc.marshal()
+	if err != nil {
+		return dbStructure, err
+	}
+	err = json.Unmarshal(dat, &dbStructure)
+	if err != nil {
+		return dbStructure, err
+	}
+	dbStructure.ensureCollections()
+	return dbStructure, nil
+}
+
+func (doc document) apply(record logRecord) error {
+	collection, _ := doc[record.Collection].(map[string]any)
+	if collection == nil {
+		collection = map[string]any{}
+		doc[record.Collection] = collection
+	}
+
+	switch record.Op {
+	case opPut:
+		decoder := json.NewDecoder(bytes.NewReader(record.Value))
+		decoder.UseNumber()
+		var v any
+		err := decoder.Decode(&v)
+		if err != nil {
+			return err
+		}
+		collection[record.Key] = v
+	case opDelete:
+		delete(collection, record.Key)
+	default:
+		return fmt.Errorf("unknown log operation %q", record.Op)
+	}
+	return nil
+}
+
+// replayLog applies every complete transaction in the log at path.
+// Each line holds one transaction; a torn last line from a crash
+// mid-append is ignored because its transaction never committed.
+func (doc document) replayLog(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		records := []logRecord{}
+		err = json.Unmarshal(line, &records)
+		if err != nil {
+			return fmt.Errorf("corrupt log %s: %w", path, err)
+		}
+		for _, record := range records {
+			err = doc.apply(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// openLog opens the log for appending, first cutting off a torn
+// last line so new transactions start on a line of their own.
+// Callers must hold the write lock.
+func (db *DB) openLog() error {
+	f, err := os.OpenFile(db.logPath(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	dat, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	size := int64(bytes.LastIndexByte(dat, '\n') + 1)
+	if size != int64(len(dat)) {
+		err = f.Truncate(size)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	_, err = f.Seek(size, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	db.logFile = f
+	db.logSize = size
+	return nil
+}
+
+// appendLog writes one transaction to the log and syncs it.
+// Callers must hold the write lock.
+func (db *DB) appendLog(records []logRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	dat, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	dat = append(dat, '\n')
+
+	_, err = db.logFile.Write(dat)
+	if err == nil {
+		err = db.logFile.Sync()
+	}
+	if err != nil {
+		// Drop whatever part of the line made it out, so the
+		// next transaction doesn't get glued onto it.
+		db.logFile.Truncate(db.logSize)
+		db.logFile.Seek(db.logSize, io.SeekStart)
+		return err
+	}
+	db.logSize += int64(len(dat))
+	return nil
+}
+
+// rotateLog moves the log aside for compaction and starts a new one.
+// Callers must hold the write lock.
+func (db *DB) rotateLog() error {
+	err := db.logFile.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(db.logPath(), db.oldLogPath())
+	if err != nil {
+		return err
+	}
+	return db.openLog()
+}
+
+// clearLogs empties the log and drops any log awaiting compaction,
+// after their contents have been written to a snapshot.
+// Callers must hold the write lock.
+func (db *DB) clearLogs() error {
+	err := os.Remove(db.oldLogPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = db.logFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = db.logFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	db.logSize = 0
+	return db.logFile.Sync()
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestTornLogTail simulates a crash in the middle of appending a
+// transaction: the torn record is dropped on open, and the next
+// transaction starts on a line of its own.
+func TestTornLogTail(t *testing.T) {
+	db, path := newTestDB(t, 1<<30)
+	for _, body := range []string{"one", "two"} {
+		_, err := db.CreateChirp(body, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeTestDB(t, db)
+
+	logFile, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = logFile.WriteString(`[{"op":"put","collection":"chirps","key":"3","value":{"id":3,"bo`)
+	if err == nil {
+		err = logFile.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopenTestDB(t, db, path)
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 {
+		t.Fatalf("got %d chirps after the torn write, want 2", len(chirps))
+	}
+
+	dat, err := os.ReadFile(path + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(dat), "\n") {
+		t.Errorf("torn record wasn't cut off: log ends with %q", dat[max(0, len(dat)-20):])
+	}
+
+	chirp, err := db.CreateChirp("three", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.ID != 3 {
+		t.Errorf("new chirp got ID %d, want 3", chirp.ID)
+	}
+
+	db = reopenTestDB(t, db, path)
+	got, err := db.GetChirp(3)
+	if err != nil {
+		t.Fatalf("chirp written after the torn record is lost: %v", err)
+	}
+	if got.Body != "three" {
+		t.Errorf("chirp 3 has body %q, want %q", got.Body, "three")
+	}
+}
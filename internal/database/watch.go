@@ -0,0 +1,78 @@
+package database
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// Watch polls the database files every interval and reloads the
+// in-memory data when they were changed outside this process, e.g.
+// edited by hand.
+// Call the returned function to stop watching.
+func (db *DB) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := db.reloadIfChanged()
+				if err != nil {
+					log.Printf("database: couldn't reload %s: %s", db.path, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (db *DB) reloadIfChanged() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !db.changedOnDisk() {
+		return nil
+	}
+
+	err := db.logFile.Close()
+	if err != nil {
+		return err
+	}
+	err = db.openLog()
+	if err != nil {
+		return err
+	}
+	err = db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	// Any compaction in flight was based on the old files.
+	db.generation++
+	log.Printf("database: reloaded %s after an outside change", db.path)
+	return nil
+}
+
+// changedOnDisk reports whether the snapshot or log differ from
+// what this DB last wrote or read. Callers must hold the lock.
+func (db *DB) changedOnDisk() bool {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false
+	}
+	if !os.SameFile(info, db.snapshotInfo) ||
+		!info.ModTime().Equal(db.snapshotInfo.ModTime()) ||
+		info.Size() != db.snapshotInfo.Size() {
+		return true
+	}
+
+	logInfo, err := os.Stat(db.logPath())
+	if err != nil {
+		return true
+	}
+	return logInfo.Size() != db.logSize
+}
@@ -0,0 +1,69 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// WriterMailer writes messages to an io.Writer instead of sending them,
+// for local development and testing.
+type WriterMailer struct {
+	from string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+func NewWriterMailer(from string, w io.Writer) *WriterMailer {
+	return &WriterMailer{from: from, w: w}
+}
+
+func (m *WriterMailer) Send(msg Message) error {
+	err := checkHeaders(msg.To, msg.Subject)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return writeMessage(m.w, m.from, msg)
+}
+
+// FileMailer appends messages to a file, opening it for each message
+// so the file can be truncated or rotated while the server runs.
+type FileMailer struct {
+	from string
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileMailer(from, path string) *FileMailer {
+	return &FileMailer{from: from, path: path}
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	err := checkHeaders(msg.To, msg.Subject)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeMessage(f, m.from, msg)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeMessage(w io.Writer, from string, msg Message) error {
+	_, err := fmt.Fprintf(w, "----- %s -----\n%s\n", time.Now().UTC().Format(time.RFC3339), format(from, msg))
+	return err
+}
@@ -0,0 +1,96 @@
+// Package mailer sends the emails Chirpy sends to its users.
+package mailer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+const (
+	KindSMTP = "smtp"
+	KindFile = "file"
+)
+
+// Config selects and configures a Mailer.
+type Config struct {
+	// Kind is KindSMTP or KindFile. There is no default: emails carry
+	// password reset and login links, so printing them by accident
+	// would leak them into the server's logs.
+	Kind string
+	From string
+
+	// SMTPAddr is the host:port of the SMTP server. SMTPUsername and
+	// SMTPPassword are optional and enable PLAIN authentication.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+
+	// FilePath is where KindFile appends messages; empty or "-"
+	// writes them to stdout, which is only fit for local development.
+	FilePath string
+}
+
+// WritesToStdout reports whether cfg prints messages to stdout.
+func (cfg Config) WritesToStdout() bool {
+	return cfg.Kind == KindFile && (cfg.FilePath == "" || cfg.FilePath == "-")
+}
+
+// New returns the Mailer described by cfg.
+func New(cfg Config) (Mailer, error) {
+	switch cfg.Kind {
+	case "":
+		return nil, fmt.Errorf("no mailer chosen: use %q, or %q for local development", KindSMTP, KindFile)
+	case KindFile:
+		if cfg.From == "" {
+			cfg.From = "chirpy@localhost"
+		}
+		if cfg.WritesToStdout() {
+			return NewWriterMailer(cfg.From, os.Stdout), nil
+		}
+		return NewFileMailer(cfg.From, cfg.FilePath), nil
+	case KindSMTP:
+		if cfg.SMTPAddr == "" || cfg.From == "" {
+			return nil, fmt.Errorf("the smtp mailer needs a server address and a from address")
+		}
+		return NewSMTPMailer(cfg.SMTPAddr, cfg.From, cfg.SMTPUsername, cfg.SMTPPassword), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", cfg.Kind)
+	}
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+// checkHeaders rejects header values that would inject extra headers.
+func checkHeaders(values ...string) error {
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid header value %q", v)
+		}
+	}
+	return nil
+}
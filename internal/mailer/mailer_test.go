@@ -0,0 +1,36 @@
+package mailer
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	mailFile := filepath.Join(t.TempDir(), "mail.txt")
+
+	tests := []struct {
+		name       string
+		cfg        Config
+		wantErr    bool
+		wantStdout bool
+	}{
+		{name: "no mailer chosen", cfg: Config{}, wantErr: true},
+		{name: "unknown mailer", cfg: Config{Kind: "carrier-pigeon"}, wantErr: true},
+		{name: "file to stdout", cfg: Config{Kind: KindFile}, wantStdout: true},
+		{name: "file to dash", cfg: Config{Kind: KindFile, FilePath: "-"}, wantStdout: true},
+		{name: "file", cfg: Config{Kind: KindFile, FilePath: mailFile}},
+		{name: "smtp", cfg: Config{Kind: KindSMTP, SMTPAddr: "localhost:25", From: "chirpy@example.com"}},
+		{name: "smtp without server", cfg: Config{Kind: KindSMTP, From: "chirpy@example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := tt.cfg.WritesToStdout(); got != tt.wantStdout {
+				t.Errorf("WritesToStdout = %v, want %v", got, tt.wantStdout)
+			}
+		})
+	}
+}
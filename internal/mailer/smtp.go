@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"net"
+	"net/smtp"
+)
+
+// SMTPMailer sends messages through an SMTP server.
+// net/smtp upgrades to TLS when the server offers STARTTLS.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := &SMTPMailer{
+		addr: addr,
+		from: from,
+	}
+	if username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	err := checkHeaders(msg.To, msg.Subject)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg))
+}
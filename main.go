@@ -5,9 +5,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Bayan2019/chirpy/internal/auth"
 	"github.com/Bayan2019/chirpy/internal/database"
+	"github.com/Bayan2019/chirpy/internal/mailer"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 
 	// 6. Authentication / 6. Authentication with JWTs
 	//Because we're using a file,
@@ -28,11 +34,27 @@ import (
 // - the secret is used to sign and verify JWTs
 // You'll want to store the jwtSecret in your apiConfig struct
 // so that your handlers can access it (jwtSecret).
+// jwtKeys replaced jwtSecret when tokens moved to a key ring.
 type apiConfig struct {
-	fileserverHits int
-	DB             *database.DB
-	jwtSecret      string
-	polkaKey       string
+	fileserverHits       int
+	DB                   database.Store
+	jwtKeys              *auth.KeyRing
+	authn                *auth.Authenticator
+	polkaKey             string
+	mailer               mailer.Mailer
+	loginLimiter         *auth.LoginLimiter
+	magicLinkLimiter     *auth.LoginLimiter
+	passwordResetLimiter *auth.LoginLimiter
+	passwordPolicy       auth.PasswordPolicy
+
+	// publicURL is where clients reach the server, for links in emails.
+	publicURL string
+	// requireVerifiedEmail stops users from chirping until they
+	// have verified their email address.
+	requireVerifiedEmail bool
+	// keepDeletedUserChirps keeps the chirps of deleted users,
+	// without an author, instead of deleting them.
+	keepDeletedUserChirps bool
 }
 
 func main() {
@@ -52,27 +74,144 @@ func main() {
 	// we'll store the secret in a gitingore'd file called .env
 	// by default, godotenv will look for a file named .env in the current directory
 	godotenv.Load(".env")
+
+	// 6. Authentication / 6. Authentication with JWTs
+	dbg := flag.Bool("debug", false, "Enable debug mode")
+	reset := flag.Bool("reset", false, "Delete all data on startup")
+	flag.Parse()
+
+	// DB_DRIVER selects the storage backend: "json" (default) keeps
+	// everything in database.json, "sqlite" uses an embedded SQLite file.
+	dbDriver := os.Getenv("DB_DRIVER")
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		dbPath = "database.json"
+		if dbDriver == database.DriverSQLite {
+			dbPath = "database.db"
+		}
+	}
+
+	// JWT_KEYS_DIR holds the PEM private keys tokens are signed with,
+	// each named <kid>.pem. JWT_ACTIVE_KEY picks the one that signs new
+	// tokens and JWT_RETIRED_KEYS (comma-separated) lists keys whose
+	// tokens are no longer accepted.
+	jwtKeysDir := os.Getenv("JWT_KEYS_DIR")
+
+	// Any arguments left after the flags name a maintenance command,
+	// e.g. `chirpy migrate status`, which runs instead of the server.
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Args(), dbDriver, dbPath, jwtKeysDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// 6. Authentication / 6. Authentication with JWTs
 	// Then you can load the JWT_SECRET variable using the standard library like
+	// JWT_SECRET is now optional once JWT_KEYS_DIR is set; keeping it
+	// lets HS256 tokens issued before the switch stay valid.
 	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	var retiredKeys []string
+	if retired := os.Getenv("JWT_RETIRED_KEYS"); retired != "" {
+		retiredKeys = strings.Split(retired, ",")
+	}
+	jwtKeys, err := auth.LoadKeyRing(jwtKeysDir, jwtSecret, os.Getenv("JWT_ACTIVE_KEY"), retiredKeys)
+	if err != nil {
+		log.Fatalf("loading JWT keys: %s", err)
 	}
 	polkaKey := os.Getenv("POLKA_KEY")
 	if polkaKey == "" {
 		log.Fatal("POLKA_KEY environment variable is not set")
 	}
 
-	// 6. Authentication / 6. Authentication with JWTs
-	db, err := database.NewDB("database.json")
+	passwordParams, err := passwordParamsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = auth.SetPasswordParams(passwordParams)
 	if err != nil {
 		log.Fatal(err)
 	}
+	passwordPolicy, err := passwordPolicyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// MAILER picks how emails are delivered and must be set: "smtp"
+	// sends them through SMTP_ADDR as MAIL_FROM, "file" appends them to
+	// MAIL_FILE, or prints them when MAIL_FILE is unset.
+	mailerConfig := mailer.Config{
+		Kind:         os.Getenv("MAILER"),
+		From:         os.Getenv("MAIL_FROM"),
+		SMTPAddr:     os.Getenv("SMTP_ADDR"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		FilePath:     os.Getenv("MAIL_FILE"),
+	}
+	mail, err := mailer.New(mailerConfig)
+	if err != nil {
+		log.Fatalf("MAILER: %s", err)
+	}
+	if mailerConfig.WritesToStdout() {
+		log.Print("WARNING: emails, including password reset and login links, are printed to stdout. " +
+			"This is for local development only; set MAILER=smtp or MAIL_FILE in production.")
+	}
+
+	// PUBLIC_URL is the server's address as seen by users, used
+	// in links sent by email.
+	publicURL := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if publicURL == "" {
+		publicURL = "http://localhost:" + port
+	}
+	// REQUIRE_VERIFIED_EMAIL=true blocks chirping until the user
+	// has clicked the link in their verification email.
+	requireVerifiedEmail := false
+	if v := os.Getenv("REQUIRE_VERIFIED_EMAIL"); v != "" {
+		requireVerifiedEmail, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid REQUIRE_VERIFIED_EMAIL: %s", err)
+		}
+	}
+
+	// DELETED_USER_CHIRPS decides what happens to the chirps of
+	// a deleted account: "delete" (the default) or "anonymize",
+	// which keeps them without an author.
+	keepDeletedUserChirps := false
+	switch v := os.Getenv("DELETED_USER_CHIRPS"); v {
+	case "", "delete":
+	case "anonymize":
+		keepDeletedUserChirps = true
+	default:
+		log.Fatalf("invalid DELETED_USER_CHIRPS %q: must be delete or anonymize", v)
+	}
 
 	// 6. Authentication / 6. Authentication with JWTs
-	dbg := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
-	if dbg != nil && *dbg {
+	db, err := database.Open(dbDriver, dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// The JSON store serves reads from memory; DB_WATCH_INTERVAL (e.g. "5s")
+	// makes it reload when database.json is edited by hand.
+	if watchInterval := os.Getenv("DB_WATCH_INTERVAL"); watchInterval != "" {
+		interval, err := time.ParseDuration(watchInterval)
+		if err != nil {
+			log.Fatalf("invalid DB_WATCH_INTERVAL: %s", err)
+		}
+		if jsonDB, ok := db.(*database.DB); ok {
+			stop := jsonDB.Watch(interval)
+			defer stop()
+		}
+	}
+
+	// --debug used to wipe the database too; that takes --reset now,
+	// so turning on debugging can't lose data by accident.
+	if *dbg && !*reset {
+		log.Print("--debug no longer deletes all data; pass --reset as well to start empty")
+	}
+	if *reset {
 		err := db.ResetDB()
 		if err != nil {
 			log.Fatal(err)
@@ -82,14 +221,35 @@ func main() {
 	apiCfg := apiConfig{
 		fileserverHits: 0,
 		DB:             db,
-		jwtSecret:      jwtSecret,
+		jwtKeys:        jwtKeys,
 		polkaKey:       polkaKey,
+		authn: &auth.Authenticator{
+			Keys:     jwtKeys,
+			Users:    db,
+			Tokens:   db,
+			Sessions: db,
+			Clients:  db,
+			Error:    respondWithError,
+		},
+		mailer:                mail,
+		loginLimiter:          auth.NewLoginLimiter(auth.DefaultAccountLimits, auth.DefaultIPLimits),
+		magicLinkLimiter:      auth.NewLoginLimiter(auth.MagicLinkAccountLimits, auth.MagicLinkIPLimits),
+		passwordResetLimiter:  auth.NewLoginLimiter(auth.MagicLinkAccountLimits, auth.MagicLinkIPLimits),
+		passwordPolicy:        passwordPolicy,
+		publicURL:             publicURL,
+		requireVerifiedEmail:  requireVerifiedEmail,
+		keepDeletedUserChirps: keepDeletedUserChirps,
 	}
 
 	// 1. Servers / 4. Server
 	// Create a new http.ServeMux
 	// mux := http.NewServeMux()
 	app_router := chi.NewRouter()
+	// TRUST_PROXY=true takes client addresses from X-Forwarded-For
+	// and X-Real-IP. Only set it behind a proxy that sets them.
+	if trustProxy, _ := strconv.ParseBool(os.Getenv("TRUST_PROXY")); trustProxy {
+		app_router.Use(middleware.RealIP)
+	}
 
 	// 1. Servers / 5. Fileservers
 	// Use a standard http.FileServer as the handler
@@ -141,7 +301,8 @@ func main() {
 	// 2. Routing / 1. Stateful Handlers
 	// register a handler on the /reset path
 	// mux.HandleFunc("/reset", apiCfg.handlerReset)
-	api_router.Get("/reset", apiCfg.handlerReset)
+	// Only admins may reset the counters.
+	api_router.With(apiCfg.authn.RequireRole(database.RoleAdmin)).Get("/reset", apiCfg.handlerReset)
 
 	// api_router.Get("/metrics", apiCfg.handlerMetrics)
 
@@ -152,7 +313,7 @@ func main() {
 	// Delete the /api/validate_chirp endpoint
 	// api_router.Post("/validate_chirp", apiCfg.handlerChirpsCreate)
 
-	// api_router.Post("/revoke", apiCfg.handlerRevoke)
+	api_router.Post("/revoke", apiCfg.handlerRevoke)
 	api_router.Post("/refresh", apiCfg.handlerRefresh)
 	// 6. Authentication / 1. Authentication with Passwords
 	// create a new POST /api/login endpoint.
@@ -160,6 +321,12 @@ func main() {
 	// 6. Authentication / 6. Authentication with JWTs
 	// Update the POST /api/login endpoint
 	api_router.Post("/login", apiCfg.handlerLogin)
+	api_router.Post("/login/mfa", apiCfg.handlerLoginMFA)
+	api_router.Post("/login/magic", apiCfg.handlerLoginMagicRequest)
+	api_router.Get("/login/magic/{token}", apiCfg.handlerLoginMagicConfirm)
+	api_router.Post("/login/magic/{token}", apiCfg.handlerLoginMagic)
+	api_router.Post("/password-reset/request", apiCfg.handlerPasswordResetRequest)
+	api_router.Post("/password-reset/confirm", apiCfg.handlerPasswordResetConfirm)
 	// 5. Storage / 7. Users
 	// Add a new endpoint to your server that allows users to be created.
 	// 6. Authentication / 1. Authentication with Passwords
@@ -170,36 +337,75 @@ func main() {
 	// create a new PUT /api/users endpoint
 	// This endpoint should update a user's email and password
 	// mux.HandleFunc("PUT /api/users", apiCfg.handlerUsersUpdate)
-	api_router.Put("/users", apiCfg.handlerUsersUpdate)
+	api_router.With(apiCfg.authn.Required).Put("/users", apiCfg.handlerUsersUpdate)
+	api_router.With(apiCfg.authn.Required).Patch("/users", apiCfg.handlerUsersPatch)
+	api_router.With(apiCfg.authn.Required).Delete("/users", apiCfg.handlerUsersDelete)
+	api_router.With(apiCfg.authn.RequireScope(auth.ScopeUsersRead)).Get("/users/export", apiCfg.handlerUsersExport)
+	api_router.Get("/users/verify", apiCfg.handlerUsersVerify)
+	api_router.With(apiCfg.authn.Required).Post("/users/verify/resend", apiCfg.handlerUsersVerifyResend)
+	api_router.With(apiCfg.authn.Required).Post("/users/mfa/totp", apiCfg.handlerTOTPEnroll)
+	api_router.With(apiCfg.authn.Required).Post("/users/mfa/totp/confirm", apiCfg.handlerTOTPConfirm)
+	api_router.With(apiCfg.authn.Required).Delete("/users/mfa/totp", apiCfg.handlerTOTPDisable)
 
 	// 5. Storage / 1. Storage
 	// This endpoint should accept a JSON payload with a body field.
 	// If all goes well, respond with a 201 status code and the full chirp resource.
-	api_router.Post("/chirps", apiCfg.handlerChirpsCreate)
+	api_router.With(apiCfg.authn.RequireScope(auth.ScopeChirpsWrite)).Post("/chirps", apiCfg.handlerChirpsCreate)
 
 	// 5. Storage / 1. Storage
 	// This endpoint should return an array of all chirps in the file, ordered by id in ascending order.
 	// mux.HandleFunc("GET /api/chirps", apiCfg.handlerChirpsRetrieve)
-	api_router.Get("/chirps", apiCfg.handlerChirpsRetrieve)
+	api_router.With(apiCfg.authn.OptionalScope(auth.ScopeChirpsRead)).Get("/chirps", apiCfg.handlerChirpsRetrieve)
 	// 5. Storage / 4. Get
 	// Add a new endpoint to your server that allows users to get a single chirp by ID.
 	// mux.HandleFunc("GET /api/chirps/{chirpID}", apiCfg.handlerChirpsGet)
-	api_router.Get("/chirps/{chirpID}", apiCfg.handlerChirpsGet)
+	api_router.With(apiCfg.authn.OptionalScope(auth.ScopeChirpsRead)).Get("/chirps/{chirpID}", apiCfg.handlerChirpsGet)
+
+	api_router.With(apiCfg.authn.RequireScope(auth.ScopeChirpsWrite)).Delete("/chirps/{chirpID}", apiCfg.handlerChirpsDelete)
 
-	api_router.Delete("/chirps/{chirpID}", apiCfg.handlerChirpsDelete)
+	// Where the user is logged in, and logging out of those places.
+	api_router.With(apiCfg.authn.Required).Get("/sessions", apiCfg.handlerSessionsList)
+	api_router.With(apiCfg.authn.Required).Delete("/sessions", apiCfg.handlerSessionsRevokeAll)
+	api_router.With(apiCfg.authn.Required).Delete("/sessions/{sessionID}", apiCfg.handlerSessionsRevoke)
+
+	// Personal access tokens for scripts and bots. Managing them
+	// takes a login; the tokens themselves can't.
+	api_router.With(apiCfg.authn.Required).Get("/tokens", apiCfg.handlerTokensList)
+	api_router.With(apiCfg.authn.Required).Post("/tokens", apiCfg.handlerTokensCreate)
+	api_router.With(apiCfg.authn.Required).Delete("/tokens/{tokenID}", apiCfg.handlerTokensRevoke)
 
 	api_router.Post("/polka/webhooks", apiCfg.handlerWebhook)
 
 	app_router.Mount("/api", api_router)
 
+	// Public keys for services that verify Chirpy tokens themselves.
+	app_router.Get("/.well-known/jwks.json", apiCfg.handlerJWKS)
+	app_router.Get("/.well-known/openid-configuration", apiCfg.handlerOpenIDConfiguration)
+
+	// OAuth 2.0 / OpenID Connect for third-party clients.
+	oauth_router := chi.NewRouter()
+	oauth_router.Get("/authorize", apiCfg.handlerOAuthAuthorize)
+	oauth_router.Post("/authorize", apiCfg.handlerOAuthAuthorizeSubmit)
+	oauth_router.Post("/token", apiCfg.handlerOAuthToken)
+	oauth_router.With(apiCfg.authn.RequireScope(auth.ScopeOpenID)).Get("/userinfo", apiCfg.handlerOAuthUserinfo)
+	oauth_router.With(apiCfg.authn.RequireScope(auth.ScopeOpenID)).Post("/userinfo", apiCfg.handlerOAuthUserinfo)
+	app_router.Mount("/oauth", oauth_router)
+
 	// 1. Servers / 4. Server
 	// mux := http.NewServeMux()
 	admin_router := chi.NewRouter()
+	// Everything under /admin is for admins only.
+	admin_router.Use(apiCfg.authn.RequireRole(database.RoleAdmin))
 
 	// 2. Routing / 1. Stateful Handlers
 	// mux.HandleFunc("/metrics", apiCfg.handlerMetrics)
 	// mux.HandleFunc("GET /admin/metrics", apiCfg.handlerMetrics)
 	admin_router.Get("/metrics", apiCfg.handlerMetrics)
+	admin_router.Get("/backup", apiCfg.handlerAdminBackup)
+	admin_router.Post("/users/{userID}/unlock", apiCfg.handlerAdminUnlockUser)
+	admin_router.Get("/oauth/clients", apiCfg.handlerAdminOAuthClientsList)
+	admin_router.Post("/oauth/clients", apiCfg.handlerAdminOAuthClientsCreate)
+	admin_router.Delete("/oauth/clients/{clientID}", apiCfg.handlerAdminOAuthClientsDelete)
 
 	app_router.Mount("/admin", admin_router)
 
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+	"github.com/Bayan2019/chirpy/internal/database"
+)
+
+const (
+	testEmail    = "user@example.com"
+	testPassword = "correct horse battery staple"
+)
+
+// newTestConfig returns a server on a fresh JSON database holding one
+// user, testEmail with testPassword.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	hashedPassword, err := auth.HashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateUser(testEmail, hashedPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := auth.NewKeyRing()
+	err = keys.Add(auth.NewHMACKey("test", []byte("test secret")))
+	if err == nil {
+		err = keys.SetActive("test")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &apiConfig{
+		DB:      db,
+		jwtKeys: keys,
+		authn: &auth.Authenticator{
+			Keys:     keys,
+			Users:    db,
+			Tokens:   db,
+			Sessions: db,
+			Clients:  db,
+			Error:    respondWithError,
+		},
+		loginLimiter:         auth.NewLoginLimiter(auth.DefaultAccountLimits, auth.DefaultIPLimits),
+		magicLinkLimiter:     auth.NewLoginLimiter(auth.MagicLinkAccountLimits, auth.MagicLinkIPLimits),
+		passwordResetLimiter: auth.NewLoginLimiter(auth.MagicLinkAccountLimits, auth.MagicLinkIPLimits),
+		publicURL:            "https://chirpy.example.com",
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+)
+
+// passwordParamsFromEnv reads how new password hashes are made:
+// PASSWORD_HASH picks "argon2id" (the default) or "bcrypt";
+// ARGON2_MEMORY_KIB, ARGON2_ITERATIONS and ARGON2_PARALLELISM tune
+// argon2id and BCRYPT_COST tunes bcrypt. Stored hashes made with
+// other settings are replaced when their users next log in.
+func passwordParamsFromEnv() (auth.PasswordParams, error) {
+	p := auth.DefaultPasswordParams
+	if algorithm := os.Getenv("PASSWORD_HASH"); algorithm != "" {
+		p.Algorithm = algorithm
+	}
+
+	settings := []struct {
+		name string
+		set  func(n uint64)
+		bits int
+	}{
+		{"ARGON2_MEMORY_KIB", func(n uint64) { p.MemoryKiB = uint32(n) }, 32},
+		{"ARGON2_ITERATIONS", func(n uint64) { p.Iterations = uint32(n) }, 32},
+		{"ARGON2_PARALLELISM", func(n uint64) { p.Parallelism = uint8(n) }, 8},
+		{"BCRYPT_COST", func(n uint64) { p.BcryptCost = int(n) }, 8},
+	}
+	for _, setting := range settings {
+		v := os.Getenv(setting.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, setting.bits)
+		if err != nil {
+			return auth.PasswordParams{}, fmt.Errorf("invalid %s: %w", setting.name, err)
+		}
+		setting.set(n)
+	}
+	return p, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/Bayan2019/chirpy/internal/auth"
+)
+
+// passwordPolicyFromEnv reads what new passwords must satisfy:
+// PASSWORD_MIN_LENGTH (default 8) characters, PASSWORD_MIN_CLASSES
+// (default 0) of lower case, upper case, digits and symbols, and not
+// the user's email unless PASSWORD_ALLOW_EMAIL=true.
+// BREACHED_PASSWORDS_DIR points at a local copy of the Pwned Passwords
+// range files to reject known breached passwords.
+func passwordPolicyFromEnv() (auth.PasswordPolicy, error) {
+	p := auth.DefaultPasswordPolicy
+
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return auth.PasswordPolicy{}, fmt.Errorf("invalid PASSWORD_MIN_LENGTH %q", v)
+		}
+		p.MinLength = n
+	}
+	if v := os.Getenv("PASSWORD_MIN_CLASSES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 4 {
+			return auth.PasswordPolicy{}, fmt.Errorf("invalid PASSWORD_MIN_CLASSES %q: must be 0 to 4", v)
+		}
+		p.MinClasses = n
+	}
+	if v := os.Getenv("PASSWORD_ALLOW_EMAIL"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return auth.PasswordPolicy{}, fmt.Errorf("invalid PASSWORD_ALLOW_EMAIL: %w", err)
+		}
+		p.DisallowEmail = !allow
+	}
+	if dir := os.Getenv("BREACHED_PASSWORDS_DIR"); dir != "" {
+		breached, err := auth.NewBreachedPasswords(dir)
+		if err != nil {
+			return auth.PasswordPolicy{}, fmt.Errorf("invalid BREACHED_PASSWORDS_DIR: %w", err)
+		}
+		p.Breached = breached
+	}
+	return p, nil
+}
+
+// checkPassword checks a new password for the user with email against
+// the password policy and hashes it. On failure it has already
+// responded.
+func (cfg *apiConfig) checkPassword(w http.ResponseWriter, password, email string) (string, bool) {
+	if !cfg.checkPasswordPolicy(w, password, email) {
+		return "", false
+	}
+
+	hashedPassword, err := auth.HashPassword(password)
+	if errors.Is(err, auth.ErrPasswordTooLong) {
+		respondWithError(w, http.StatusBadRequest, "Password is too long")
+		return "", false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password")
+		return "", false
+	}
+	return hashedPassword, true
+}
+
+// checkPasswordPolicy responds with every rule password breaks, if
+// any. An empty email skips the rule against using it as password.
+func (cfg *apiConfig) checkPasswordPolicy(w http.ResponseWriter, password, email string) bool {
+	type response struct {
+		Error       string                 `json:"error"`
+		FailedRules []auth.PolicyViolation `json:"failed_rules"`
+	}
+
+	violations, err := cfg.passwordPolicy.Check(password, email)
+	if err != nil {
+		log.Printf("Error checking breached passwords: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check password")
+		return false
+	}
+	if len(violations) > 0 {
+		respondWithJSON(w, http.StatusBadRequest, response{
+			Error:       "Password doesn't meet the requirements",
+			FailedRules: violations,
+		})
+		return false
+	}
+	return true
+}